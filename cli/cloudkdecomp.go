@@ -3,6 +3,7 @@ package main
 // Computing GHDs with a distributed search for separators, first prototype
 
 import (
+	"context"
 	"flag"
 	"fmt"
 	"io/ioutil"
@@ -11,24 +12,15 @@ import (
 	"reflect"
 	"runtime"
 	"runtime/pprof"
+	"strings"
 	"time"
 
+	"cloud.google.com/go/pubsub"
 	algo "github.com/cem-okulmus/BalancedGo/algorithms"
 	"github.com/cem-okulmus/BalancedGo/lib"
 	cloudlib "github.com/cem-okulmus/GHDDistributedSearch/lib"
 )
 
-func logActive(b bool) {
-	if b {
-		log.SetOutput(os.Stderr)
-
-		log.SetFlags(0)
-	} else {
-
-		log.SetOutput(ioutil.Discard)
-	}
-}
-
 func check(e error) {
 	if e != nil {
 		panic(e)
@@ -45,7 +37,13 @@ func (l labelTime) String() string {
 	return fmt.Sprintf("%s : %.5f ms", l.label, l.time)
 }
 
-func output(algorithm string, decomp lib.Decomp, times []labelTime, graph lib.Graph, gml string, K int) {
+func toMsec(d time.Duration) float64 {
+	return d.Seconds() * float64(time.Second/time.Millisecond)
+}
+
+func output(algorithm string, decomp lib.Decomp, times []labelTime, stats cloudlib.StatsSummary,
+	costs cloudlib.CostSummary, chunks *cloudlib.ChunkSizer, sim *cloudlib.SimTransport, shadow *cloudlib.Shadow,
+	graph lib.Graph, gml string, K int) {
 	decomp.RestoreSubedges()
 
 	fmt.Println("Used algorithm: " + algorithm)
@@ -64,6 +62,70 @@ func output(algorithm string, decomp lib.Decomp, times []labelTime, graph lib.Gr
 		fmt.Println(time)
 	}
 
+	fmt.Println("\nWorker Statistics: ")
+	workerTimes := []labelTime{
+		{time: toMsec(stats.WallTime), label: "Worker wall time"},
+		{time: toMsec(stats.CPUTime), label: "Worker CPU time"},
+	}
+	for _, time := range workerTimes {
+		fmt.Println(time)
+	}
+	fmt.Println("Solutions received: ", stats.Solutions)
+	fmt.Println("Candidates generated: ", stats.Candidates)
+	fmt.Println("Predicate checks: ", stats.Checks)
+	fmt.Println("Graph from cache: ", stats.CachedGraph)
+	fmt.Println("Distinct workers: ", len(stats.Workers))
+	fmt.Println("Searches run locally: ", stats.LocalSearches)
+	fmt.Println("Searches distributed: ", stats.RemoteSearches)
+	fmt.Println("Speculative requests: ", stats.Speculative)
+	if stats.Failed > 0 {
+		fmt.Println("Searches failed: ", stats.Failed)
+	}
+
+	if chunks != nil {
+		summary := chunks.Summary()
+		fmt.Println("\nChunk Sizing: ")
+		fmt.Printf("Average throughput: %.1f candidate edges/s\n", summary.Rate)
+		fmt.Println("Last chunk size: ", summary.LastChunk)
+		for worker, rate := range summary.Rates {
+			fmt.Printf("  %s : %.1f candidate edges/s\n", worker, rate)
+		}
+	}
+
+	fmt.Println("\nCost Estimate: ")
+	fmt.Println("Invocations: ", costs.Invocations)
+	fmt.Println("Bytes sent: ", costs.BytesSent)
+	fmt.Println("Bytes received: ", costs.BytesReceived)
+	fmt.Printf("Compute: %.3f s\n", costs.ComputeTime.Seconds())
+	fmt.Printf("Estimated cost: $%.6f\n", costs.Cost)
+	if costs.Exceeded && costs.LocalFallbacks > 0 {
+		fmt.Println("Budget exceeded, searches run locally: ", costs.LocalFallbacks)
+	}
+	if costs.Aborted > 0 {
+		fmt.Println("Budget exceeded, searches aborted: ", costs.Aborted)
+	}
+
+	if sim != nil {
+		summary := sim.Summary()
+		fmt.Println("\nSimulation: ")
+		fmt.Println(labelTime{time: toMsec(summary.Elapsed), label: "Projected wall-clock time"})
+		fmt.Println(labelTime{time: toMsec(summary.ColdTime), label: "Time spent in cold starts"})
+		fmt.Println("Requests: ", summary.Requests)
+		fmt.Println("Cold starts: ", summary.ColdStarts)
+		fmt.Println("Instances started: ", summary.Instances)
+		fmt.Printf("Utilization: %.1f%%\n", summary.Utilization*100)
+	}
+
+	if shadow != nil {
+		summary := shadow.Summary()
+		fmt.Println("\nShadow Mode: ")
+		fmt.Println("Searches compared: ", summary.Compared)
+		fmt.Println("Searches diverged: ", summary.Diverged)
+		if summary.Dumped > 0 {
+			fmt.Println("Requests dumped to "+shadow.Dir+": ", summary.Dumped)
+		}
+	}
+
 	fmt.Println("\nWidth: ", decomp.CheckWidth())
 	var correct bool
 	correct = decomp.Correct(graph)
@@ -80,6 +142,13 @@ func output(algorithm string, decomp lib.Decomp, times []labelTime, graph lib.Gr
 }
 
 func main() {
+	// a failed run exits once everything else has been cleaned up
+	exitCode := 0
+	defer func() {
+		if exitCode != 0 {
+			os.Exit(exitCode)
+		}
+	}()
 
 	// ==============================================
 	// Command-Line Argument Parsing
@@ -107,12 +176,54 @@ func main() {
 	//other optional  flags
 	cpuprofile := flagSet.String("cpuprofile", "", "write cpu profile to file")
 	logging := flagSet.Bool("log", false, "turn on extensive logs")
+	logLevel := flagSet.String("loglevel", "info", "Minimum level of log entries: debug, info, warn, error or off")
 	balanceFactorFlag := flagSet.Int("balfactor", 2, "Changes the factor that balanced separator check uses, default 2")
 	numCPUs := flagSet.Int("cpu", -1, "Set number of CPUs to use")
 	bench := flagSet.Bool("bench", false, "Benchmark mode, reduces unneeded output (incompatible with -log flag)")
 	gml := flagSet.String("gml", "", "Output the produced decomposition into the specified gml file ")
 	pace := flagSet.Bool("pace", false, "Use PACE 2019 format for graphs (see pacechallenge.org/2019/htd/htd_format/)")
 	meta := flagSet.Int("meta", 0, "meta parameter for LogKHybrid")
+	metricsAddr := flagSet.String("metrics", "", "Expose Prometheus metrics on the given address (e.g. :9090)")
+	traceExporter := flagSet.String("trace", "", "Export traces to \"stdout\" or \"file:<path>\"")
+	maxInvocations := flagSet.Int("maxInvocations", 0, "Budget: maximal number of worker invocations (0 for no limit)")
+	maxCost := flagSet.Float64("maxCost", 0, "Budget: maximal estimated cost in dollars (0 for no limit)")
+	budgetFallback := flagSet.Bool("budgetFallback", false, "Search locally once the budget is exceeded, instead of aborting")
+	priceInvocation := flagSet.Float64("priceInvocation", cloudlib.DefaultPrices.PerInvocation, "Price in dollars per worker invocation")
+	priceCompute := flagSet.Float64("priceCompute", cloudlib.DefaultPrices.PerComputeSecond, "Price in dollars per second of worker compute")
+	chunkTarget := flagSet.Duration("chunkTarget", 0, "Split the search into chunks taking about this long on a worker (e.g. 2s), 0 to disable")
+	chunkInitial := flagSet.Int("chunkInitial", 1000, "Number of candidates in a chunk, until the worker throughput is known")
+	speculate := flagSet.Float64("speculate", 0, "Resend requests running longer than this multiple of the median latency, 0 to disable")
+	speculateQuantile := flagSet.Float64("speculateQuantile", 0.75, "Fraction of requests that must be answered before resending stragglers")
+	heartbeat := flagSet.Duration("heartbeat", 0, "Let workers report their progress at this interval (e.g. 5s), 0 to disable")
+	heartbeatTimeout := flagSet.Duration("heartbeatTimeout", time.Minute, "Resume a request if its worker has not reported for this long")
+	offload := flagSet.Float64("offload", 0, "Search locally if the estimated work (candidates times subgraph edges) is below this threshold")
+	projectID := flagSet.String("project", "hgtest-1", "Google Cloud Platform project ID (set PUBSUB_EMULATOR_HOST to use the emulator)")
+	provision := flagSet.Bool("provision", false, "Create the topics if they do not exist")
+	answerSub := flagSet.String("answerSub", cloudlib.DefaultTopology.AnswerSubscription, "Receive the answers from this shared subscription")
+	runSub := flagSet.Bool("runSubscription", false, "Receive the answers on a subscription created for this run, filtered by its ID, instead of -answerSub (needs the rights to create subscriptions)")
+	publishDelay := flagSet.Duration("publishDelay", pubsub.DefaultPublishSettings.DelayThreshold, "Maximal time to batch requests before publishing them")
+	publishCount := flagSet.Int("publishCount", pubsub.DefaultPublishSettings.CountThreshold, "Maximal number of requests published in one batch")
+	simulate := flagSet.Bool("simulate", false, "Simulate the workers in virtual time, and project the wall-clock time and cost")
+	simWorkers := flagSet.Int("simWorkers", cloudlib.DefaultLatencyModel.Workers, "Simulation: maximal number of worker instances")
+	simPublish := flagSet.Duration("simPublish", cloudlib.DefaultLatencyModel.Publish, "Simulation: time for a message to be delivered")
+	simColdStart := flagSet.Duration("simColdStart", cloudlib.DefaultLatencyModel.ColdStart, "Simulation: median time to start a worker instance")
+	simCheckCost := flagSet.Duration("simCheckCost", cloudlib.DefaultLatencyModel.CheckCost, "Simulation: compute time per candidate and subgraph edge")
+	simSeed := flagSet.Int64("simSeed", 1, "Simulation: seed of the random cold starts")
+	shadowMode := flagSet.Bool("shadow", false, "Check every distributed search against a local search, logging any divergence")
+	shadowDir := flagSet.String("shadowDir", "", "Shadow mode: dump the requests of divergent searches to this directory")
+	captureDir := flagSet.String("capture", "", "Write every request and solution to this directory, to be run again with replay")
+	pipeWorkers := flagSet.Int("pipe", 0, "Run the workers as this many subprocesses connected by pipes, instead of using Pub/Sub")
+	workerCommand := flagSet.String("workerCommand", "worker", "Worker binary started by -pipe")
+	tcpWorkers := flagSet.String("tcp", "", "Send the requests to the workers listening on these comma-separated host:port addresses, instead of using Pub/Sub")
+	websocketAddr := flagSet.String("websocket", "", "Let workers join over a WebSocket at ws://<address>/ws (e.g. :7080), instead of using Pub/Sub")
+	websocketToken := flagSet.String("websocketToken", "", "Only let workers join -websocket which present this token (see the -token flag of the worker)")
+	websocketOrigins := flagSet.String("websocketOrigins", "", "Comma-separated origins of the web pages allowed to join -websocket (e.g. https://example.org), only the host of the master if empty")
+	httpWorkers := flagSet.String("http", "", "POST the requests to these comma-separated worker URLs, instead of using Pub/Sub")
+	httpTimeout := flagSet.Duration("httpTimeout", 5*time.Minute, "Time -http waits for the answer to a request, including its search, before sending it again (0 for no limit)")
+	balance := flagSet.String("balance", "leastLoaded", "How -tcp, -websocket and -http pick the worker of a request: leastLoaded or roundRobin")
+	sessions := flagSet.Bool("sessions", false, "Send the graph of a search only once to each worker, which keeps it for the later requests (needs long-lived workers, e.g. -pipe, -tcp, -websocket or -http)")
+	workerRetries := flagSet.Int("workerRetries", 2, "Times a request is resent after its worker process exited, its connection dropped or its HTTP request failed, before searching it locally")
+	priceGB := flagSet.Float64("priceGB", cloudlib.DefaultPrices.PerGB, "Price in dollars per GB of messages")
 
 	parseError := flagSet.Parse(os.Args[1:])
 	if parseError != nil {
@@ -185,10 +296,26 @@ func main() {
 		defer pprof.StopCPUProfile()
 	}
 
+	level, err := cloudlib.ParseLevel(*logLevel)
+	check(err)
+	if *logging {
+		level = cloudlib.LevelDebug
+	}
 	if *bench { // no logging output when running benchmarks
-		*logging = false
+		level = cloudlib.LevelError
 	}
-	logActive(*logging)
+	logger := cloudlib.NewLogger(os.Stderr, level)
+
+	// the algorithms of BalancedGo trace their progress on the standard logger, which is only of
+	// interest when debugging
+	log.SetFlags(0)
+	log.SetOutput(logger.Writer(cloudlib.LevelDebug))
+
+	cloudlib.ServeMetrics(*metricsAddr)
+
+	shutdownTracing, err := cloudlib.SetupTracing(*traceExporter, "ghd-master")
+	check(err)
+	defer shutdownTracing()
 
 	BalFactor := *balanceFactorFlag
 
@@ -208,7 +335,7 @@ func main() {
 	originalGraph := parsedGraph
 
 	if !*bench { // skip any output if bench flag is set
-		log.Println("BIP: ", parsedGraph.GetBIP())
+		logger.Debug("Parsed graph", "bip", parsedGraph.GetBIP())
 	}
 
 	var reducedGraph lib.Graph
@@ -352,7 +479,168 @@ func main() {
 
 	if solver != nil {
 
-		solver.SetGenerator(cloudlib.DistSearchGen{})
+		ctx, span := cloudlib.Tracer().Start(context.Background(), "decomposition")
+		subproblems := cloudlib.NewSubproblems(ctx)
+		stats := &cloudlib.RunStats{}
+		costs := cloudlib.NewCostTracker(cloudlib.Prices{
+			PerInvocation:    *priceInvocation,
+			PerComputeSecond: *priceCompute,
+			PerGB:            *priceGB,
+		}, cloudlib.Budget{
+			MaxInvocations: *maxInvocations,
+			MaxCost:        *maxCost,
+			Fallback:       *budgetFallback,
+		})
+
+		var chunks *cloudlib.ChunkSizer
+		if *chunkTarget > 0 {
+			chunks = cloudlib.NewChunkSizer(*chunkTarget, *chunkInitial)
+		}
+
+		var speculation *cloudlib.Speculation
+		if *speculate > 0 {
+			speculation = &cloudlib.Speculation{Quantile: *speculateQuantile, Multiple: *speculate}
+		}
+
+		var heartbeats *cloudlib.Heartbeats
+		if *heartbeat > 0 {
+			heartbeats = &cloudlib.Heartbeats{Interval: *heartbeat, Timeout: *heartbeatTimeout}
+		}
+
+		var shadow *cloudlib.Shadow
+		if *shadowMode {
+			shadow = &cloudlib.Shadow{Dir: *shadowDir}
+		}
+
+		runID := cloudlib.NewRunID()
+		var sim *cloudlib.SimTransport
+		var transport cloudlib.Transport
+
+		if *simulate {
+			if speculation != nil || heartbeats != nil {
+				logger.Warn("Speculation and heartbeats rely on real time, disabled in the simulation")
+				speculation, heartbeats = nil, nil
+			}
+
+			model := cloudlib.DefaultLatencyModel
+			model.Workers = *simWorkers
+			model.Publish = *simPublish
+			model.ColdStart = *simColdStart
+			model.CheckCost = *simCheckCost
+			sim = &cloudlib.SimTransport{Model: model, Seed: *simSeed}
+			transport = sim
+		} else if *pipeWorkers > 0 {
+			transport = &cloudlib.PipeTransport{
+				Command: *workerCommand,
+				Args:    []string{"-pipe", "-loglevel", *logLevel},
+				Workers: *pipeWorkers,
+				Retries: *workerRetries,
+				Logger:  logger,
+			}
+		} else if *tcpWorkers != "" {
+			balancing, err := cloudlib.ParseBalancing(*balance)
+			check(err)
+			transport = &cloudlib.TCPTransport{
+				Addrs:     strings.Split(*tcpWorkers, ","),
+				Balancing: balancing,
+				Retries:   *workerRetries,
+				Logger:    logger,
+			}
+		} else if *httpWorkers != "" {
+			balancing, err := cloudlib.ParseBalancing(*balance)
+			check(err)
+			transport = &cloudlib.HTTPTransport{
+				URLs:      strings.Split(*httpWorkers, ","),
+				Balancing: balancing,
+				Retries:   *workerRetries,
+				Timeout:   *httpTimeout,
+				Logger:    logger,
+			}
+		} else if *websocketAddr != "" {
+			balancing, err := cloudlib.ParseBalancing(*balance)
+			check(err)
+			ws := &cloudlib.WebSocketTransport{
+				Addr:      *websocketAddr,
+				Balancing: balancing,
+				Retries:   *workerRetries,
+				Logger:    logger,
+				Token:     *websocketToken,
+			}
+			if *websocketOrigins != "" {
+				ws.Origins = strings.Split(*websocketOrigins, ",")
+			}
+			transport = ws
+		} else {
+			topology := cloudlib.DefaultTopology
+			topology.AnswerSubscription = *answerSub
+			subscription := *answerSub
+
+			if *provision || *runSub {
+				admin, err := pubsub.NewClient(ctx, *projectID)
+				check(err)
+				defer admin.Close()
+
+				// with a subscription of its own, this run receives only its own answers
+				if *runSub {
+					topology.AnswerSubscription = ""
+				}
+				var teardown func(context.Context) error
+				switch {
+				case *provision && *runSub:
+					subscription, teardown, err = topology.Provision(ctx, admin, runID)
+				case *runSub:
+					subscription, teardown, err = topology.SubscribeRun(ctx, admin, runID)
+				default:
+					err = topology.EnsureTopics(ctx, admin)
+				}
+				check(err)
+
+				if teardown != nil {
+					logger.Info("Subscribed to answers of this run", "subscription", subscription)
+					defer func() {
+						if err := teardown(context.Background()); err != nil {
+							logger.Warn("Failed to delete subscription", "subscription", subscription, "error", err)
+						}
+					}()
+				}
+			}
+
+			// one connection is shared by all searches of the decomposition
+			settings := pubsub.DefaultPublishSettings
+			settings.DelayThreshold = *publishDelay
+			settings.CountThreshold = *publishCount
+			transport = &cloudlib.PubSubTransport{
+				ProjectID:      *projectID,
+				TopicID:        topology.RequestTopic,
+				SubscriptionID: subscription,
+				Settings:       &settings,
+			}
+		}
+
+		if *captureDir != "" {
+			transport = &cloudlib.CaptureTransport{Transport: transport, Dir: *captureDir, Logger: logger}
+		}
+
+		dispatcher := &cloudlib.Dispatcher{Transport: transport, Logger: logger}
+		defer dispatcher.Close() // before the subscription is deleted
+
+		logger.Info("Starting decomposition", "run", runID, "graph", *graphPath, "width", *width)
+		solver.SetGenerator(cloudlib.DistSearchGen{
+			Context: ctx,
+			Stats:   stats,
+			Logger:  logger,
+			RunID:   runID,
+			Costs:   costs,
+			Chunks:  chunks,
+
+			OffloadThreshold: *offload,
+			Speculation:      speculation,
+			Heartbeats:       heartbeats,
+			Dispatcher:       dispatcher,
+			Shadow:           shadow,
+			Subproblems:      subproblems,
+			Sessions:         *sessions,
+		})
 
 		var decomp lib.Decomp
 		start := time.Now()
@@ -364,6 +652,8 @@ func main() {
 		}
 
 		d := time.Now().Sub(start)
+		subproblems.End()
+		span.End()
 		msec := d.Seconds() * float64(time.Second/time.Millisecond)
 		times = append(times, labelTime{time: msec, label: "lib.Decomposition"})
 
@@ -384,7 +674,20 @@ func main() {
 		if !reflect.DeepEqual(decomp, lib.Decomp{}) {
 			decomp.Graph = originalGraph
 		}
-		output(solver.Name(), decomp, times, originalGraph, *gml, *width)
+		output(solver.Name(), decomp, times, stats.Summary(), costs.Summary(), chunks, sim, shadow,
+			originalGraph, *gml, *width)
+
+		if aborted := costs.Summary().Aborted; aborted > 0 {
+			// the missing decomposition does not tell whether one of the width exists
+			fmt.Fprintln(os.Stderr, "Aborted: the budget was exceeded before the search completed, "+
+				"so the result is incomplete (use -budgetFallback to finish locally)")
+			exitCode = 3
+		}
+		if failed := stats.Summary().Failed; failed > 0 {
+			fmt.Fprintln(os.Stderr, "Failed: a search could not be completed, so the result is incomplete "+
+				"(see the log for the error)")
+			exitCode = 4
+		}
 
 		return
 	}
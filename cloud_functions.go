@@ -1,14 +1,14 @@
 package cloudfunction
 
 import (
-	"bytes"
 	"context"
-	"encoding/gob"
 	"fmt"
 	"log"
+	"net/http"
+	"os"
+	"sync"
 
 	"cloud.google.com/go/pubsub"
-	"github.com/cem-okulmus/BalancedGo/lib"
 
 	cloudlib "github.com/cem-okulmus/GHDDistributedSearch/lib"
 )
@@ -17,113 +17,83 @@ import (
 // See the documentation for more details:
 // https://cloud.google.com/pubsub/docs/reference/rest/v1/PubsubMessage
 type PubSubMessage struct {
-	Data []byte `json:"data"`
+	Data       []byte            `json:"data"`
+	Attributes map[string]string `json:"attributes"`
 }
 
-// WorkerDistributedSearch replies to a request
-func WorkerDistributedSearch(ctx context.Context, m PubSubMessage) error {
-	buffer := bytes.NewBuffer(m.Data)
-	dec := gob.NewDecoder(buffer)
-
-	var request cloudlib.Request
-
-	var pred lib.Predicate
-	var genExample lib.Generator
-
-	pred = lib.BalancedCheck{}
-	genExample = &lib.CombinationIterator{}
+// worker keeps the state of this function instance
+var worker *cloudlib.Worker
 
-	gob.Register(pred)
+// the answer topic is kept for the lifetime of the function instance, since setting up the client
+// takes longer than handling most requests
+var (
+	topicMux sync.Mutex
+	answers  *pubsub.Topic
+)
 
-	pred = lib.ParentCheck{}
-	gob.Register(pred)
+// answerTopic returns the topic to publish the answers to, connecting on first use
+func answerTopic() (*pubsub.Topic, error) {
+	topicMux.Lock()
+	defer topicMux.Unlock()
 
-	gob.Register(genExample)
+	if answers != nil {
+		return answers, nil
+	}
 
-	err := dec.Decode(&request) // parse the incoming byte slice
+	// Sets your Google Cloud Platform project ID.
+	projectID := "hgtest-1"
 
+	// the client outlives the invocation, so it must not be bound to its context
+	client, err := pubsub.NewClient(context.Background(), projectID)
 	if err != nil {
-		fmt.Println("Read input from message,", m.Data)
-		fmt.Println("Decode error", err)
-		return nil
+		return nil, err
 	}
+	answers = client.Topic("answerTopic")
 
-	// fmt.Println("Allowed edges received, and order: ")
-
-	// for _, e := range request.Edges.Slice() {
-	// 	fmt.Println(e.Name, "(", (e.Vertices), ")")
-	// }
-
-	// create the generator based on info in the request
-
-	gen := request.Gen
-
-	// let it run to completion, and then send back the Solution struct
-	var solution []int
-
-	defer func() {
-		if r := recover(); r != nil {
-			fmt.Println("Recovered from panic: ", r)
-
-			fmt.Print("Current request type: ")
-			fmt.Println("Subgraph length: ", request.Subgraph.Edges.Len())
-			fmt.Println("gen last returned sep:", request.Gen.GetNext())
-		}
-	}()
-
-	var sep lib.Edges
-
-	for gen.HasNext() && len(solution) == 0 {
-		// j := make([]int, len(gen.Combination))
-		// copy(gen.Combination, j)
-		j := gen.GetNext()
-
-		sep = lib.GetSubset(request.Edges, j) // check new possible sep
-
-		if request.Predicate.Check(&request.Subgraph, &sep, request.BalFactor) {
-			gen.Found() // cache result
-
-			solution = make([]int, len(j))
-			copy(solution, j)
-			// log.Printf("Worker %d \" won \"", workernum)
-			// gen.Confirm()
+	return answers, nil
+}
 
-		}
-		gen.Confirm()
+func init() {
+	// logging and tracing are configured through the environment of the deployed function
+	level, err := cloudlib.ParseLevel(os.Getenv("LOG_LEVEL"))
+	if err != nil {
+		level = cloudlib.LevelInfo
 	}
+	worker = cloudlib.NewWorker(cloudlib.NewLogger(os.Stdout, level))
 
-	// Sets your Google Cloud Platform project ID.
-	projectID := "hgtest-1"
-
-	// Creates a client.
+	if _, err := cloudlib.SetupTracing(os.Getenv("TRACE_EXPORTER"), "ghd-worker"); err != nil {
+		worker.Logger.Warn("Tracing disabled", "error", err)
+	}
+}
 
-	client, err := pubsub.NewClient(ctx, projectID)
+// WorkerDistributedSearch replies to a request
+func WorkerDistributedSearch(ctx context.Context, m PubSubMessage) error {
+	topic, err := answerTopic()
 	if err != nil {
+		worker.Logger.Error("Failed to create client", "error", err)
 		log.Fatalf("Failed to create client: %v", err)
 	}
-	defer client.Close()
-
-	topic := client.Topic("answerTopic") // try to create topic
 
-	sol := cloudlib.Solution{
-		Valid:     len(solution) > 0,
-		Selection: solution,
-		Gen:       gen,
-		ID:        request.ID,
+	// progress reports are sent without waiting for them to be published
+	emit := func(data []byte, attrs map[string]string) {
+		topic.Publish(ctx, &pubsub.Message{
+			Data:       data,
+			Attributes: attrs,
+		})
 	}
-	fmt.Println("Passing on the ID: ", sol.ID)
-
-	// encode the solution into []byte
-	var Encodebuffer bytes.Buffer
-	enc := gob.NewEncoder(&Encodebuffer)
 
-	err = enc.Encode(sol)
+	data, attrs, err := worker.Handle(ctx, m.Data, m.Attributes, emit)
+	if err == cloudlib.ErrDuplicate || err == cloudlib.ErrNoReply {
+		return nil // the other delivery will reply, if any reply is needed
+	}
 	if err != nil {
-		log.Fatal("Encoding error: ", err)
+		worker.Logger.Error("Failed to handle request", "error", err, "bytes", len(m.Data))
+		return nil
 	}
 
 	result := topic.Publish(ctx, &pubsub.Message{
-		Data: Encodebuffer.Bytes(),
+		Data:       data,
+		Attributes: attrs,
 	})
 
 	_, err = result.Get(ctx)
@@ -131,11 +101,10 @@ func WorkerDistributedSearch(ctx context.Context, m PubSubMessage) error {
 		return fmt.Errorf("Get: %v", err)
 	}
 
-	// fmt.Print("Send the solution", sol)
-
-	// if len(solution) > 0 {
-	// 	fmt.Print("Solution vertices: ", sep.Vertices())
-	// }
-
 	return nil
 }
+
+// WorkerHTTP answers a request POSTed by the master, replying with the solution directly
+func WorkerHTTP(w http.ResponseWriter, r *http.Request) {
+	worker.ServeHTTP(w, r)
+}
@@ -1,8 +1,42 @@
 module github.com/cem-okulmus/GHDDistributedSearch
 
-go 1.16
+go 1.18
 
 require (
 	cloud.google.com/go/pubsub v1.11.0
 	github.com/cem-okulmus/BalancedGo v1.6.10
+	github.com/gorilla/websocket v1.5.0
+	github.com/prometheus/client_golang v1.10.0
+	go.opentelemetry.io/otel v1.14.0
+	go.opentelemetry.io/otel/exporters/stdout/stdouttrace v1.14.0
+	go.opentelemetry.io/otel/sdk v1.14.0
+	go.opentelemetry.io/otel/trace v1.14.0
+	google.golang.org/api v0.47.0
+	google.golang.org/grpc v1.38.0
+)
+
+require (
+	cloud.google.com/go v0.82.0 // indirect
+	github.com/alecthomas/participle v0.3.0 // indirect
+	github.com/beorn7/perks v1.0.1 // indirect
+	github.com/cespare/xxhash/v2 v2.1.2 // indirect
+	github.com/go-logr/logr v1.2.3 // indirect
+	github.com/go-logr/stdr v1.2.2 // indirect
+	github.com/golang/groupcache v0.0.0-20200121045136-8c9f03a8e57e // indirect
+	github.com/golang/protobuf v1.5.2 // indirect
+	github.com/google/go-cmp v0.5.9 // indirect
+	github.com/googleapis/gax-go/v2 v2.0.5 // indirect
+	github.com/matttproud/golang_protobuf_extensions v1.0.1 // indirect
+	github.com/prometheus/client_model v0.2.0 // indirect
+	github.com/prometheus/common v0.18.0 // indirect
+	github.com/prometheus/procfs v0.7.3 // indirect
+	github.com/spakin/disjoint v0.0.0-20170506060253-925e67a26b59 // indirect
+	go.opencensus.io v0.23.0 // indirect
+	golang.org/x/net v0.0.0-20210503060351-7fd8e65b6420 // indirect
+	golang.org/x/oauth2 v0.0.0-20210514164344-f6687ab2804c // indirect
+	golang.org/x/sync v0.0.0-20210220032951-036812b2e83c // indirect
+	golang.org/x/sys v0.7.0 // indirect
+	golang.org/x/text v0.3.6 // indirect
+	google.golang.org/genproto v0.0.0-20210524142926-3e3a6030be83 // indirect
+	google.golang.org/protobuf v1.26.0 // indirect
 )
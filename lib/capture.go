@@ -0,0 +1,163 @@
+package lib
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+
+	"github.com/cem-okulmus/BalancedGo/lib"
+)
+
+// extension of the files solutions are captured to, next to their requests
+const solutionExt = ".sol"
+
+// A CaptureTransport wraps another Transport and writes every request sent and every solution
+// received to a directory, named after the request ID. A captured request can be run again with
+// the replay command. Progress messages are not captured.
+//
+// The requests of a session are captured with the graph sent along with the first request of the
+// session, so that each can be replayed on its own. The messages closing a session are not
+// captured.
+type CaptureTransport struct {
+	Transport Transport
+	Dir       string
+	Logger    *Logger // optional, DefaultLogger is used if not set
+
+	mux      sync.Mutex
+	sessions map[string]sessionGraph // the graphs of the open sessions
+}
+
+// the graph of a session, as sent along with its first request
+type sessionGraph struct {
+	subgraph lib.Graph
+	edges    lib.Edges
+}
+
+// CaptureFiles returns the files a request and its solution are captured to
+func CaptureFiles(dir string, id string) (request string, solution string) {
+	return filepath.Join(dir, id+requestExt), filepath.Join(dir, id+solutionExt)
+}
+
+// write stores the data of a message, failures are only logged so the search is not affected
+func (c *CaptureTransport) write(msg Message, solution bool) {
+	logger := c.Logger
+	if logger == nil {
+		logger = DefaultLogger
+	}
+
+	id, err := messageID(msg)
+	if err != nil || id == "" {
+		logger.Warn("Cannot capture message without request ID", "error", err)
+		return
+	}
+
+	if err = os.MkdirAll(c.Dir, 0755); err != nil {
+		logger.Warn("Failed to create capture directory", "error", err, "dir", c.Dir)
+		return
+	}
+
+	file, solFile := CaptureFiles(c.Dir, id)
+	if solution {
+		file = solFile
+	}
+	if err = ioutil.WriteFile(file, msg.Data, 0644); err != nil {
+		logger.Warn("Failed to capture message", "error", err, "file", file)
+	}
+}
+
+// Send captures a request and passes it on
+func (c *CaptureTransport) Send(ctx context.Context, msg Message) error {
+	if data := c.standalone(msg); data != nil {
+		c.write(Message{Data: data, Attributes: msg.Attributes}, false)
+	}
+
+	return c.Transport.Send(ctx, msg)
+}
+
+// standalone returns the data of a request which can be replayed on its own, adding the graph of
+// its session if it was not sent along. It returns nil for a message which is not to be captured.
+func (c *CaptureTransport) standalone(msg Message) []byte {
+	session := msg.Attributes[attrSession]
+	if session == "" {
+		return msg.Data
+	}
+
+	c.mux.Lock()
+	defer c.mux.Unlock()
+
+	if c.sessions == nil {
+		c.sessions = make(map[string]sessionGraph)
+	}
+	if msg.Attributes[attrType] == typeClose {
+		delete(c.sessions, session)
+		return nil
+	}
+
+	logger := c.Logger
+	if logger == nil {
+		logger = DefaultLogger
+	}
+
+	req, err := Limits{}.decode(msg.Data)
+	if err != nil {
+		logger.Warn("Cannot capture request of session", "error", err, "session", session)
+		return nil
+	}
+
+	if req.Subgraph.Edges.Len() > 0 {
+		c.sessions[session] = sessionGraph{subgraph: req.Subgraph, edges: req.Edges}
+	} else if graph, ok := c.sessions[session]; ok {
+		req.Subgraph, req.Edges = graph.subgraph, graph.edges
+	} else {
+		logger.Warn("Cannot capture request of session opened before", "session", session, "request", req.ID)
+		return nil
+	}
+	req.Session = ""
+
+	data, err := EncodeRequest(req)
+	if err != nil {
+		logger.Warn("Failed to encode captured request", "error", err)
+		return nil
+	}
+
+	return data
+}
+
+// Receive captures the solutions received before handing them on
+func (c *CaptureTransport) Receive(ctx context.Context, handle func(msg Message) bool) error {
+	return c.Transport.Receive(ctx, func(msg Message) bool {
+		if !IsProgress(msg.Attributes) {
+			c.write(msg, true)
+		}
+		return handle(msg)
+	})
+}
+
+// Close closes the wrapped Transport
+func (c *CaptureTransport) Close() error {
+	return c.Transport.Close()
+}
+
+// idle captures the solutions delivered by a wrapped idler, such as a SimTransport
+func (c *CaptureTransport) idle(deliver func(msg Message) bool, ready func() bool) {
+	i, ok := c.Transport.(idler)
+	if !ok {
+		return
+	}
+
+	i.idle(func(msg Message) bool {
+		if !IsProgress(msg.Attributes) {
+			c.write(msg, true)
+		}
+		return deliver(msg)
+	}, ready)
+}
+
+// untrusted passes on whether the wrapped Transport is trusted
+func (c *CaptureTransport) untrusted() bool {
+	u, ok := c.Transport.(untrustedTransport)
+
+	return ok && u.untrusted()
+}
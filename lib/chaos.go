@@ -0,0 +1,232 @@
+package lib
+
+import (
+	"context"
+	"errors"
+	"math/rand"
+	"sync"
+	"time"
+)
+
+// Faults configures the delivery failures injected by a ChaosTransport. Every probability is
+// applied to each message independently, both to the requests sent and to the messages received.
+type Faults struct {
+	Drop      float64 // the message is lost
+	Duplicate float64 // the message is delivered twice
+	Delay     float64 // the message is delivered late, by up to MaxDelay
+	Reorder   float64 // the message is held back until the next one has been delivered
+	Corrupt   float64 // some bytes of the message data are flipped
+
+	MaxDelay time.Duration // of delayed messages, also the longest a reordered one is held back
+	Seed     int64         // makes the sequence of injected faults reproducible
+}
+
+// A ChaosTransport wraps another Transport and injects faults into the messages passing through
+// it, to test how the search copes with the failures Pub/Sub can cause. Faults are decided in
+// the order in which messages arrive, so with the same seed and the same order the same faults
+// are injected.
+type ChaosTransport struct {
+	Transport Transport
+	Faults    Faults
+	Logger    *Logger // optional, every injected fault is logged at debug level
+
+	once      sync.Once
+	mux       sync.Mutex
+	rng       *rand.Rand
+	counts    map[string]int // number of injected faults, by kind
+	sending   heldBack
+	receiving heldBack
+}
+
+// heldBack keeps the message which is being reordered in one direction
+type heldBack struct {
+	mux     sync.Mutex
+	msg     *Message
+	deliver func(Message)
+	timer   *time.Timer
+}
+
+// errRejected is passed back from a received message that the handler did not accept
+var errRejected = errors.New("message rejected")
+
+// roll decides whether a fault with the given probability occurs, the lock must be held
+func (c *ChaosTransport) roll(kind string, p float64) bool {
+	if p <= 0 || c.rng.Float64() >= p {
+		return false
+	}
+	c.counts[kind]++
+
+	return true
+}
+
+// Send passes a request on to the wrapped Transport, possibly after injecting faults
+func (c *ChaosTransport) Send(ctx context.Context, msg Message) error {
+	return c.inject(ctx, &c.sending, msg, func(ctx context.Context, msg Message) error {
+		return c.Transport.Send(ctx, msg)
+	})
+}
+
+// Receive passes the messages of the wrapped Transport on to handle, possibly after injecting
+// faults. Messages which are delayed or reordered are accepted right away, and are lost if handle
+// does not accept them later.
+func (c *ChaosTransport) Receive(ctx context.Context, handle func(msg Message) bool) error {
+	return c.Transport.Receive(ctx, func(msg Message) bool {
+		err := c.inject(ctx, &c.receiving, msg, func(ctx context.Context, msg Message) error {
+			if !handle(msg) {
+				return errRejected
+			}
+			return nil
+		})
+
+		return err != errRejected
+	})
+}
+
+// Close releases any held back messages and closes the wrapped Transport
+func (c *ChaosTransport) Close() error {
+	for _, h := range []*heldBack{&c.sending, &c.receiving} {
+		h.mux.Lock()
+		if h.timer != nil {
+			h.timer.Stop()
+		}
+		h.msg = nil
+		h.mux.Unlock()
+	}
+
+	return c.Transport.Close()
+}
+
+// Injected returns the number of faults injected so far, by kind
+func (c *ChaosTransport) Injected() map[string]int {
+	c.mux.Lock()
+	defer c.mux.Unlock()
+
+	out := make(map[string]int)
+	for k, v := range c.counts {
+		out[k] = v
+	}
+
+	return out
+}
+
+// inject decides the faults of a message and delivers it accordingly. The error of an immediate
+// delivery is returned, those of later deliveries are only logged.
+func (c *ChaosTransport) inject(ctx context.Context, h *heldBack, msg Message,
+	deliver func(context.Context, Message) error) error {
+	c.once.Do(func() {
+		c.rng = rand.New(rand.NewSource(c.Faults.Seed))
+		c.counts = make(map[string]int)
+	})
+
+	logger := c.Logger
+	if logger == nil {
+		logger = DefaultLogger
+	}
+	logger = logger.With("request", msg.Attributes[attrRequest])
+
+	c.mux.Lock()
+	f := c.Faults
+	drop := c.roll("drop", f.Drop)
+	corrupt := !drop && c.roll("corrupt", f.Corrupt)
+	duplicate := !drop && c.roll("duplicate", f.Duplicate)
+	delay := !drop && c.roll("delay", f.Delay)
+	reorder := !drop && !delay && c.roll("reorder", f.Reorder)
+	var wait time.Duration
+	if delay && f.MaxDelay > 0 {
+		wait = time.Duration(c.rng.Int63n(int64(f.MaxDelay)))
+	}
+	if corrupt {
+		msg = c.corrupt(msg)
+	}
+	c.mux.Unlock()
+
+	if drop {
+		logger.Debug("Injected fault", "fault", "drop")
+		return nil
+	}
+	if corrupt {
+		logger.Debug("Injected fault", "fault", "corrupt")
+	}
+
+	copies := 1
+	if duplicate {
+		logger.Debug("Injected fault", "fault", "duplicate")
+		copies = 2
+	}
+
+	// later deliveries are no longer bound to the context of the caller
+	later := func(msg Message) {
+		for i := 0; i < copies; i++ {
+			if err := deliver(context.Background(), msg); err != nil && err != errRejected {
+				logger.Warn("Late delivery failed", "error", err)
+			}
+		}
+	}
+
+	switch {
+	case delay:
+		logger.Debug("Injected fault", "fault", "delay", "delay", wait)
+		time.AfterFunc(wait, func() { later(msg) })
+		return nil
+	case reorder:
+		logger.Debug("Injected fault", "fault", "reorder")
+		h.hold(msg, later, f.MaxDelay)
+		return nil
+	}
+
+	var err error
+	for i := 0; i < copies && err == nil; i++ {
+		err = deliver(ctx, msg)
+	}
+	h.release() // a message held back is delivered after this one
+
+	return err
+}
+
+// corrupt returns a copy of the message with a few bytes of its data flipped, the lock must be held
+func (c *ChaosTransport) corrupt(msg Message) Message {
+	if len(msg.Data) == 0 {
+		return msg
+	}
+
+	data := make([]byte, len(msg.Data))
+	copy(data, msg.Data)
+	flips := 1 + c.rng.Intn(3)
+	for i := 0; i < flips; i++ {
+		data[c.rng.Intn(len(data))] ^= byte(1 + c.rng.Intn(255))
+	}
+
+	return Message{Data: data, Attributes: msg.Attributes}
+}
+
+// hold keeps a message back until the next one has been delivered, or at most for the given
+// time. A message already held back is released first.
+func (h *heldBack) hold(msg Message, deliver func(Message), limit time.Duration) {
+	h.release()
+
+	if limit <= 0 {
+		limit = monitorInterval
+	}
+
+	h.mux.Lock()
+	defer h.mux.Unlock()
+
+	h.msg = &msg
+	h.deliver = deliver
+	h.timer = time.AfterFunc(limit, h.release)
+}
+
+// release delivers the message held back, if any
+func (h *heldBack) release() {
+	h.mux.Lock()
+	msg, deliver := h.msg, h.deliver
+	h.msg = nil
+	if h.timer != nil {
+		h.timer.Stop()
+	}
+	h.mux.Unlock()
+
+	if msg != nil {
+		deliver(*msg)
+	}
+}
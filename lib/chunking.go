@@ -0,0 +1,123 @@
+package lib
+
+import (
+	"sync"
+	"time"
+)
+
+// rateSmoothing is the weight of a new observation in the moving average of a worker's rate
+const rateSmoothing = 0.3
+
+// A ChunkSizer decides how many candidates each request should check, aiming for a target
+// compute time per invocation. It learns the throughput of every worker from the statistics
+// sent back in the solutions. The throughput is measured in checked candidates times subgraph
+// edges per second, as the cost of a check grows with the size of the subgraph.
+// It is safe for concurrent use.
+type ChunkSizer struct {
+	Target  time.Duration // compute time to aim for in each invocation
+	Initial int           // number of candidates per chunk, until the throughput is known
+	Min     int           // lower bound on the chunk size
+	Max     int           // upper bound on the chunk size, 0 for none
+
+	mux   sync.Mutex
+	rates map[string]float64 // moving average of the throughput, by worker ID
+	last  int                // size of the last chunk handed out
+}
+
+// A ChunkSummary describes the current estimates of a ChunkSizer
+type ChunkSummary struct {
+	Rates     map[string]float64 // throughput by worker ID
+	Rate      float64            // the average throughput used for sizing
+	LastChunk int                // size of the last chunk handed out
+}
+
+// NewChunkSizer produces a ChunkSizer aiming for the given compute time per invocation
+func NewChunkSizer(target time.Duration, initial int) *ChunkSizer {
+	return &ChunkSizer{
+		Target:  target,
+		Initial: initial,
+		Min:     1,
+		rates:   make(map[string]float64),
+	}
+}
+
+// Observe updates the throughput estimate of a worker with a received solution
+func (c *ChunkSizer) Observe(sol Solution, subgraphEdges int) {
+	if sol.Checks == 0 || sol.WallTime <= 0 {
+		return
+	}
+	if subgraphEdges < 1 {
+		subgraphEdges = 1
+	}
+
+	rate := float64(sol.Checks*subgraphEdges) / sol.WallTime.Seconds()
+
+	c.mux.Lock()
+	defer c.mux.Unlock()
+
+	if c.rates == nil {
+		c.rates = make(map[string]float64)
+	}
+
+	if old, ok := c.rates[sol.WorkerID]; ok {
+		c.rates[sol.WorkerID] = (1-rateSmoothing)*old + rateSmoothing*rate
+	} else {
+		c.rates[sol.WorkerID] = rate
+	}
+}
+
+// rate returns the average throughput over all workers, the lock must be held
+func (c *ChunkSizer) rate() float64 {
+	if len(c.rates) == 0 {
+		return 0
+	}
+
+	var sum float64
+	for _, r := range c.rates {
+		sum += r
+	}
+
+	return sum / float64(len(c.rates))
+}
+
+// Next returns the number of candidates to check in the next request on a subgraph of the given size
+func (c *ChunkSizer) Next(subgraphEdges int) int {
+	c.mux.Lock()
+	defer c.mux.Unlock()
+
+	if subgraphEdges < 1 {
+		subgraphEdges = 1
+	}
+
+	size := c.Initial
+	if rate := c.rate(); rate > 0 {
+		size = int(rate * c.Target.Seconds() / float64(subgraphEdges))
+	}
+
+	if size < c.Min {
+		size = c.Min
+	}
+	if c.Max > 0 && size > c.Max {
+		size = c.Max
+	}
+	c.last = size
+
+	return size
+}
+
+// Summary returns the current estimates
+func (c *ChunkSizer) Summary() ChunkSummary {
+	c.mux.Lock()
+	defer c.mux.Unlock()
+
+	out := ChunkSummary{
+		Rates:     make(map[string]float64),
+		Rate:      c.rate(),
+		LastChunk: c.last,
+	}
+	for k, v := range c.rates {
+		out.Rates[k] = v
+	}
+
+	return out
+}
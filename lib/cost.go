@@ -0,0 +1,145 @@
+package lib
+
+import (
+	"sync"
+	"time"
+)
+
+// Prices used to estimate the cost of a run, in dollars
+type Prices struct {
+	PerInvocation    float64 // for each invocation of a worker function
+	PerComputeSecond float64 // for each second a worker spends on a request
+	PerGB            float64 // for each GB of messages sent or received
+}
+
+// DefaultPrices follow the public list prices of Cloud Functions (1st gen, 256MB / 400MHz)
+// and Pub/Sub message delivery
+var DefaultPrices = Prices{
+	PerInvocation:    0.0000004,
+	PerComputeSecond: 0.00000463,
+	PerGB:            40.0 / 1024,
+}
+
+// A Budget limits how much a run may spend on the distributed search. Zero values mean no limit.
+type Budget struct {
+	MaxInvocations int
+	MaxCost        float64 // in dollars, as estimated with the prices of the tracker
+	Fallback       bool    // continue with a local search once exceeded, instead of aborting
+}
+
+// A CostSummary lists what was spent during a run
+type CostSummary struct {
+	Invocations    int
+	BytesSent      int
+	BytesReceived  int
+	ComputeTime    time.Duration
+	Cost           float64 // estimated, in dollars
+	Exceeded       bool    // true if the budget has been reached
+	LocalFallbacks int     // number of searches run locally due to the budget
+	Aborted        int     // number of searches aborted due to the budget, making the result incomplete
+}
+
+// A CostTracker accounts for the invocations and traffic of a run, and enforces its budget.
+// It is safe for concurrent use.
+type CostTracker struct {
+	Prices Prices
+	Budget Budget
+
+	mux     sync.Mutex
+	summary CostSummary
+}
+
+// NewCostTracker produces a CostTracker with the given prices and budget
+func NewCostTracker(prices Prices, budget Budget) *CostTracker {
+	return &CostTracker{Prices: prices, Budget: budget}
+}
+
+// cost estimates the cost of the current summary, the lock must be held
+func (c *CostTracker) cost() float64 {
+	s := c.summary
+	gb := float64(s.BytesSent+s.BytesReceived) / (1 << 30)
+
+	return float64(s.Invocations)*c.Prices.PerInvocation +
+		s.ComputeTime.Seconds()*c.Prices.PerComputeSecond +
+		gb*c.Prices.PerGB
+}
+
+// AddRequest records a request of the given size sent to a worker
+func (c *CostTracker) AddRequest(bytes int) {
+	c.mux.Lock()
+	defer c.mux.Unlock()
+
+	c.summary.Invocations++
+	c.summary.BytesSent += bytes
+}
+
+// AddSolution records a solution of the given size received from a worker
+func (c *CostTracker) AddSolution(bytes int, sol Solution) {
+	c.mux.Lock()
+	defer c.mux.Unlock()
+
+	c.summary.BytesReceived += bytes
+	c.summary.ComputeTime += sol.WallTime
+}
+
+// addFallback records a search that was run locally due to the budget
+func (c *CostTracker) addFallback() {
+	c.mux.Lock()
+	defer c.mux.Unlock()
+
+	c.summary.LocalFallbacks++
+}
+
+// addAbort records a search that was aborted due to the budget
+func (c *CostTracker) addAbort() {
+	c.mux.Lock()
+	defer c.mux.Unlock()
+
+	c.summary.Aborted++
+}
+
+// Allows returns true if the budget leaves room for sending the given number of requests, as
+// estimated from the price of their invocations. Otherwise the budget is marked as exceeded.
+func (c *CostTracker) Allows(requests int) bool {
+	if c.Exceeded() {
+		return false
+	}
+
+	c.mux.Lock()
+	defer c.mux.Unlock()
+
+	if c.Budget.MaxInvocations > 0 && c.summary.Invocations+requests > c.Budget.MaxInvocations {
+		c.summary.Exceeded = true
+	}
+	if c.Budget.MaxCost > 0 && c.cost()+float64(requests)*c.Prices.PerInvocation > c.Budget.MaxCost {
+		c.summary.Exceeded = true
+	}
+
+	return !c.summary.Exceeded
+}
+
+// Exceeded returns true once the budget has been reached
+func (c *CostTracker) Exceeded() bool {
+	c.mux.Lock()
+	defer c.mux.Unlock()
+
+	if c.Budget.MaxInvocations > 0 && c.summary.Invocations >= c.Budget.MaxInvocations {
+		c.summary.Exceeded = true
+	}
+	if c.Budget.MaxCost > 0 && c.cost() >= c.Budget.MaxCost {
+		c.summary.Exceeded = true
+	}
+
+	return c.summary.Exceeded
+}
+
+// Summary returns what was spent so far
+func (c *CostTracker) Summary() CostSummary {
+	c.mux.Lock()
+	defer c.mux.Unlock()
+
+	out := c.summary
+	out.Cost = c.cost()
+
+	return out
+}
@@ -0,0 +1,11 @@
+//go:build windows || plan9 || js
+// +build windows plan9 js
+
+package lib
+
+import "time"
+
+// cpuTime is not supported on this platform, and always returns zero
+func cpuTime() time.Duration {
+	return 0
+}
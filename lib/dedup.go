@@ -0,0 +1,70 @@
+package lib
+
+import (
+	"errors"
+	"sync"
+)
+
+// ErrDuplicate is returned by a Worker for a request which it is already working on
+var ErrDuplicate = errors.New("request is already being handled")
+
+// attribute carrying the request ID, so duplicates can be recognised without decoding
+const attrRequest = "request"
+
+// a reply sent for a request, kept to answer redeliveries of the same request
+type reply struct {
+	data  []byte
+	attrs map[string]string
+}
+
+// A recentCache remembers the last few IDs it was given, together with a value for each.
+// It is safe for concurrent use.
+type recentCache struct {
+	mux     sync.Mutex
+	entries map[string]*reply
+	order   []string // ring buffer of the IDs, to evict the oldest one
+	next    int
+}
+
+// newRecentCache produces a recentCache holding up to size IDs
+func newRecentCache(size int) *recentCache {
+	if size < 1 {
+		size = 1
+	}
+
+	return &recentCache{
+		entries: make(map[string]*reply),
+		order:   make([]string, size),
+	}
+}
+
+// add stores an ID, evicting the oldest one if the cache is full
+func (r *recentCache) add(id string, value *reply) {
+	r.mux.Lock()
+	defer r.mux.Unlock()
+
+	if _, ok := r.entries[id]; ok {
+		r.entries[id] = value
+		return
+	}
+
+	delete(r.entries, r.order[r.next])
+	r.order[r.next] = id
+	r.next = (r.next + 1) % len(r.order)
+	r.entries[id] = value
+}
+
+// get returns the value of an ID, and whether the ID is known
+func (r *recentCache) get(id string) (*reply, bool) {
+	r.mux.Lock()
+	defer r.mux.Unlock()
+
+	value, ok := r.entries[id]
+
+	return value, ok
+}
+
+// settled keeps the IDs of requests on the master whose solutions are no longer awaited,
+// either since they have been received already or since the request was abandoned. Any
+// (re)delivery of these is acknowledged and dropped.
+var settled = newRecentCache(1 << 16)
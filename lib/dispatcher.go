@@ -0,0 +1,278 @@
+package lib
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+// A Message is an encoded Solution or Progress sent back by a worker, with its attributes
+type Message struct {
+	Data       []byte
+	Attributes map[string]string
+}
+
+// a search waiting for messages from the workers. Its queue is unbounded, so that the receiver
+// never blocks on a search which is busy, and no solution is ever dropped.
+type waiter struct {
+	mux   sync.Mutex
+	queue []Message
+	ready chan struct{} // signalled while the queue is not empty
+	done  chan struct{} // closed once the search no longer waits
+}
+
+// newWaiter produces a waiter with an empty queue
+func newWaiter() *waiter {
+	return &waiter{
+		ready: make(chan struct{}, 1),
+		done:  make(chan struct{}),
+	}
+}
+
+// put queues a message, without blocking
+func (w *waiter) put(msg Message) {
+	w.mux.Lock()
+	w.queue = append(w.queue, msg)
+	w.mux.Unlock()
+
+	w.signal()
+}
+
+// next takes the oldest message from the queue, it returns false if the queue is empty
+func (w *waiter) next() (Message, bool) {
+	w.mux.Lock()
+	defer w.mux.Unlock()
+
+	if len(w.queue) == 0 {
+		return Message{}, false
+	}
+	msg := w.queue[0]
+	w.queue[0] = Message{} // not kept alive by the backing array
+	w.queue = w.queue[1:]
+	if len(w.queue) > 0 {
+		w.signal()
+	}
+
+	return msg, true
+}
+
+// queued returns the number of messages waiting to be taken
+func (w *waiter) queued() int {
+	w.mux.Lock()
+	defer w.mux.Unlock()
+
+	return len(w.queue)
+}
+
+// signal marks the queue as not empty, unless this is already known
+func (w *waiter) signal() {
+	select {
+	case w.ready <- struct{}{}:
+	default:
+	}
+}
+
+// A Dispatcher is the single receiver of the messages sent back by the workers within a process.
+// It routes each message by its request ID to the search waiting for it, using a table of pending
+// requests. This way any number of searches can run concurrently on the same subscription, without
+// receiving each other's messages. It also owns the Transport, so that connections are set up once
+// and reused by all searches.
+type Dispatcher struct {
+	Transport Transport
+	Logger    *Logger
+
+	mux     sync.Mutex
+	pending map[string]*waiter // by request ID
+	running bool
+	cancel  context.CancelFunc // stops the receiver
+	stopped chan struct{}      // closed once the receiver has returned
+}
+
+// DefaultDispatcher is used by all searches which do not specify their own Dispatcher
+var DefaultDispatcher = &Dispatcher{
+	Transport: &PubSubTransport{
+		ProjectID:      "hgtest-1",
+		TopicID:        "workerTopic",
+		SubscriptionID: "answerTopic-sub",
+	},
+}
+
+// send delivers a request whose messages are routed to a waiter. The waiter is registered before
+// sending, so that even the fastest answer finds it.
+func (d *Dispatcher) send(ctx context.Context, id string, msg Message, w *waiter) error {
+	d.register(id, w)
+
+	return d.Transport.Send(ctx, msg)
+}
+
+// register routes all messages for a request ID to a waiter, starting to receive if needed
+func (d *Dispatcher) register(id string, w *waiter) {
+	d.mux.Lock()
+	defer d.mux.Unlock()
+
+	if d.pending == nil {
+		d.pending = make(map[string]*waiter)
+	}
+	d.pending[id] = w
+
+	if !d.running {
+		ctx, cancel := context.WithCancel(context.Background())
+		d.running = true
+		d.cancel = cancel
+		d.stopped = make(chan struct{})
+		go d.receive(ctx, d.stopped)
+	}
+}
+
+// unregister removes a request ID from the table, any later messages for it are dropped
+func (d *Dispatcher) unregister(id string) {
+	d.mux.Lock()
+	defer d.mux.Unlock()
+
+	delete(d.pending, id)
+	settled.add(id, nil)
+}
+
+// receive runs the long-lived receiver. If receiving fails, it is started again after a pause
+// while searches are waiting, and otherwise by the next registration.
+func (d *Dispatcher) receive(ctx context.Context, stopped chan struct{}) {
+	logger := d.Logger
+	if logger == nil {
+		logger = DefaultLogger
+	}
+
+	defer close(stopped)
+
+	delay := time.Second
+	for {
+		err := d.Transport.Receive(ctx, func(msg Message) bool {
+			ack, _ := d.route(msg, logger) // unknown messages might be meant for another master
+			return ack
+		})
+		if err != nil && err != ErrClosed && ctx.Err() == nil {
+			masterErrors.WithLabelValues("receive").Inc()
+			logger.Error("Receiving stopped", "error", err, "retry", delay)
+
+			select { // avoid spinning if the subscription is unavailable
+			case <-ctx.Done():
+			case <-time.After(delay):
+			}
+			if delay *= 2; delay > maxReconnectDelay {
+				delay = maxReconnectDelay
+			}
+		}
+
+		d.mux.Lock()
+		if err == nil || err == ErrClosed || ctx.Err() != nil || len(d.pending) == 0 {
+			if d.stopped == stopped {
+				d.running = false
+			}
+			d.mux.Unlock()
+			return
+		}
+		d.mux.Unlock()
+	}
+}
+
+// Close stops receiving and closes the Transport. Searches still waiting receive nothing more.
+func (d *Dispatcher) Close() error {
+	d.mux.Lock()
+	running, cancel, stopped := d.running, d.cancel, d.stopped
+	d.running = false
+	d.mux.Unlock()
+
+	if running {
+		cancel()
+		<-stopped
+	}
+
+	return d.Transport.Close()
+}
+
+// route hands a message to the waiting search. It returns whether to acknowledge the message,
+// which is false if nobody in this process is waiting for it, or has been in the past, and
+// whether a search received it.
+func (d *Dispatcher) route(msg Message, logger *Logger) (ack bool, delivered bool) {
+	id, err := messageID(msg)
+	if err != nil {
+		masterErrors.WithLabelValues("decode").Inc()
+		logger.Error("Decode error", "error", err, "bytes", len(msg.Data))
+		return true, false // will never be readable, so don't let it come back
+	}
+
+	d.mux.Lock()
+	w, ok := d.pending[id]
+	d.mux.Unlock()
+
+	if !ok {
+		if _, old := settled.get(id); old {
+			duplicates.WithLabelValues("master").Inc()
+			logger.Debug("Dropping message of settled request", "received", id)
+			return true, false
+		}
+		unroutedMessages.Inc()
+		logger.Warn("Received message for unknown request", "received", id)
+		return false, false
+	}
+
+	select {
+	case <-w.done: // the search has just ended
+		return true, false
+	default:
+	}
+	w.put(msg)
+
+	return true, true
+}
+
+// An idler is a Transport which only delivers messages while a search is waiting for them. It
+// delivers until ready returns true, or it has nothing left to deliver.
+type idler interface {
+	idle(deliver func(msg Message) bool, ready func() bool)
+}
+
+// wait is called by a search before it blocks on its waiter, letting an idler deliver until the
+// waiter has received a message
+func (d *Dispatcher) wait(w *waiter) {
+	i, ok := d.Transport.(idler)
+	if !ok {
+		return
+	}
+
+	logger := d.Logger
+	if logger == nil {
+		logger = DefaultLogger
+	}
+
+	i.idle(func(msg Message) bool {
+		_, delivered := d.route(msg, logger)
+		return delivered
+	}, func() bool {
+		return w.queued() > 0
+	})
+}
+
+// An untrustedTransport reaches workers which may send back anything, so their separators have
+// to be checked by the master
+type untrustedTransport interface {
+	untrusted() bool
+}
+
+// untrusted returns true if the separators found by the workers have to be checked
+func (d *Dispatcher) untrusted() bool {
+	u, ok := d.Transport.(untrustedTransport)
+
+	return ok && u.untrusted()
+}
+
+// messageID returns the request ID of a message, preferably from its attributes
+func messageID(msg Message) (string, error) {
+	if id, ok := msg.Attributes[attrRequest]; ok {
+		return id, nil
+	}
+
+	// sent by an older worker, always a solution
+	sol, err := DecodeSolution(msg.Data)
+
+	return sol.ID, err
+}
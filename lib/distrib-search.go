@@ -5,10 +5,12 @@ import (
 	"context"
 	"encoding/gob"
 	"fmt"
-	"log"
+	"sync"
+	"sync/atomic"
+	"time"
 
-	"cloud.google.com/go/pubsub"
 	"github.com/cem-okulmus/BalancedGo/lib"
+	"go.opentelemetry.io/otel/trace"
 )
 
 // DistributedSearch implements a search module that distributes the search for separators to
@@ -21,21 +23,123 @@ type DistributedSearch struct {
 	Result          []int
 	Generators      []lib.Generator
 	ExhaustedSearch bool
+	Context         context.Context // carries the trace of the decomposition this search is part of
+	Stats           *RunStats
+	Logger          *Logger
+	RunID           string
+	Costs           *CostTracker
+	Local           bool // true if the search is small enough to be done locally
+	Chunks          *ChunkSizer
+	Speculation     *Speculation
+	Heartbeats      *Heartbeats
+	Dispatcher      *Dispatcher // carries the requests and routes the answers, DefaultDispatcher if nil
+	Shadow          *Shadow     // optional, compares every result with a local search
+	Sessions        bool        // true if the workers hold the graph in a session, see Request
+	Aborted         bool        // true if the search was given up as the budget was exceeded
+	Err             error       // set if the search failed, in which case its result is incomplete
+
+	finished   []bool      // marks the generators which have been exhausted
+	subproblem *subproblem // the span of the subproblem, if traced
+	session    string      // prefix of the session IDs of the generators, set once the first is opened
+	opened     []bool      // marks the generators whose session has been opened on a worker
+	mux        sync.Mutex  // guards a search shared between goroutines
 }
 
 // DistSearchGen is needed to use the DistributedSearch module for the search
-type DistSearchGen struct{}
+type DistSearchGen struct {
+	Context context.Context // optional, parent context for all searches (e.g. the span of a decomposition)
+	Stats   *RunStats       // optional, collects the worker statistics of all searches
+	Logger  *Logger         // optional, DefaultLogger is used if not set
+	RunID   string          // optional, identifies the run in requests and logs
+	Costs   *CostTracker    // optional, accounts for the cost of the run and enforces its budget
+
+	// OffloadThreshold is the estimated work (search space times subgraph size, see EstimateWork)
+	// from which on a search is distributed, anything smaller is searched locally. Zero always
+	// distributes.
+	OffloadThreshold float64
+
+	// Chunks is optional, if set each request only checks up to a number of candidates, sized
+	// by the throughput observed so far. Otherwise each request runs its generator to the end.
+	Chunks *ChunkSizer
+
+	// Speculation is optional, if set straggling requests are sent out a second time
+	Speculation *Speculation
+
+	// Heartbeats is optional, if set the workers report their progress while searching
+	Heartbeats *Heartbeats
+
+	// Dispatcher is optional, DefaultDispatcher is used if not set
+	Dispatcher *Dispatcher
+
+	// Shadow is optional, if set every distributed result is checked against a local search
+	Shadow *Shadow
+
+	// Subproblems is optional, if set the searches of each subproblem are traced as children
+	// of a span for the subproblem, nested along the recursion
+	Subproblems *Subproblems
+
+	// Sessions sends the graph of a search only with the first request of each generator, the
+	// worker keeps it for the later ones. This needs workers which live as long as the search.
+	Sessions bool
+}
+
+// processRunID is used for searches that were not given a run ID
+var processRunID = newID()
+
+// NewRunID produces a random ID for a run, i.e. one decomposition
+func NewRunID() string {
+	return newID()
+}
+
+// requestCounter is used to produce request IDs unique within this process
+var requestCounter uint64
+
+// newRequestID produces a unique ID for the next request of a run
+func newRequestID(runID string) string {
+	return fmt.Sprintf("%s-%d", runID, atomic.AddUint64(&requestCounter, 1))
+}
 
 // GetSearch produces the corresponding Search interface of the DistributedSearch module
 func (dg DistSearchGen) GetSearch(H *lib.Graph, Edges *lib.Edges, BalFactor int, Gens []lib.Generator) lib.Search {
-	return &DistributedSearch{
+	search := &DistributedSearch{
 		H:               *H,
 		Edges:           Edges,
 		BalFactor:       BalFactor,
 		Result:          []int{},
 		Generators:      Gens,
 		ExhaustedSearch: false,
+		Context:         dg.Context,
+		Stats:           dg.Stats,
+		Logger:          dg.Logger,
+		RunID:           dg.RunID,
+		Costs:           dg.Costs,
+		Chunks:          dg.Chunks,
+		Speculation:     dg.Speculation,
+		Heartbeats:      dg.Heartbeats,
+		Dispatcher:      dg.Dispatcher,
+		Shadow:          dg.Shadow,
+		Sessions:        dg.Sessions,
 	}
+
+	if dg.Subproblems != nil {
+		search.subproblem = dg.Subproblems.start(H, Edges.Len())
+		search.Context = search.subproblem.ctx
+	}
+
+	if dg.OffloadThreshold > 0 {
+		work := EstimateWork(H, Edges, Gens)
+		search.Local = work >= 0 && work < dg.OffloadThreshold
+	}
+	if search.Local {
+		offloadDecisions.WithLabelValues("local").Inc()
+	} else {
+		offloadDecisions.WithLabelValues("remote").Inc()
+	}
+	if dg.Stats != nil {
+		dg.Stats.addDecision(search.Local)
+	}
+
+	return search
 }
 
 // A Request sent over pubsub to the workers
@@ -46,6 +150,15 @@ type Request struct {
 	Gen       lib.Generator
 	BalFactor int
 	ID        string
+	RunID     string
+	Limit     int // maximal number of candidates to check, 0 for no limit
+
+	ProgressInterval time.Duration // how often to report progress, 0 for never
+
+	// ID of the session holding the graph on the worker, empty if not part of one. The subgraph
+	// and edges are only sent along to open the session.
+	Session string
+	Close   bool // closes the session, nothing is searched
 }
 
 // A Solution is the result sent back by the workers
@@ -54,6 +167,19 @@ type Solution struct {
 	ID        string
 	Selection []int         // the selection of edges to form the separator, empty if valid is false
 	Gen       lib.Generator // sending back the generator to keep track of search state
+
+	LimitReached bool // true if the search stopped at the limit, before the generator was exhausted
+
+	// execution statistics of the worker
+	Candidates  int           // number of candidates produced by the generator
+	Checks      int           // number of times the predicate was checked
+	WallTime    time.Duration // time spent searching
+	CPUTime     time.Duration // CPU time consumed by the worker process while searching
+	WorkerID    string        // identifies the worker instance
+	GraphCached bool          // true if the worker reused graph state from an earlier request
+
+	Error       string // set if the worker rejected the request, in which case nothing was searched
+	SessionLost bool   // set if the worker did not hold the session of the request, which has to be sent again with the graph
 }
 
 // TODO
@@ -63,155 +189,666 @@ type Solution struct {
 //  * write the distributed search below to send requests
 //
 
+// a chunk of the search space, sent out to the workers and waiting for its solution
+type chunk struct {
+	index  int       // the generator which is continued by this chunk
+	limit  int       // the number of candidates to check
+	start  time.Time // when the request was published
+	logger *Logger
+	twin   string // ID of the speculative copy of this request, or of its original
+
+	lastSeen time.Time // when the request was published or its worker last reported progress
+	checked  int       // number of candidates checked according to the last progress report
+
+	from   *lib.CombinationIterator // copy of the generator sent, to check those sent back
+	misled bool                     // set if the worker reported progress outside of the chunk
+}
+
+// remaining returns the limit for continuing the chunk from its last reported position
+func (c *chunk) remaining() int {
+	if c.limit <= 0 {
+		return c.limit
+	}
+	if c.limit-c.checked < 1 {
+		return 1
+	}
+
+	return c.limit - c.checked
+}
+
 // FindNext starts the search and stops if some separator which satisfies the predicate
-// is found, or if the entire search space has been exhausted
+// is found, or if the entire search space has been exhausted. The search is distributed by
+// sending out each generator as a separate request, and if chunk sizes are used, each request
+// continues the state of the generator where the previous chunk left off.
 func (d *DistributedSearch) FindNext(pred lib.Predicate) {
+	d.mux.Lock()
+	defer d.mux.Unlock()
 
-	// set up request struct
+	runID := d.RunID
+	if runID == "" {
+		runID = processRunID
+	}
 
-	// fmt.Println("Unencoded graph: ")
+	logger := d.Logger
+	if logger == nil {
+		logger = DefaultLogger
+	}
+	logger = logger.With("run", runID, "subgraph", d.H.Edges.Len())
 
-	// for _, e := range d.Edges.Slice() {
-	// 	fmt.Println(e, "(", (e.Vertices), ")")
-	// }
+	d.Result = []int{} // reset result
+	if d.subproblem != nil {
+		defer d.subproblem.touch()
+	}
 
-	req := Request{
-		Subgraph:  d.H,
-		Edges:     *d.Edges,
-		Predicate: pred,
-		Gen:       d.Generators[0],
-		BalFactor: d.BalFactor,
-		ID:        "random", // should be fine? 🤷‍♀️️
+	if d.Local {
+		logger.Debug("Searching locally")
+		d.searchLocally(pred)
+		return
 	}
 
-	// Set up connection to the topic
+	var fanOut int // the requests sent out right away
+	for i := range d.Generators {
+		if d.finished == nil || !d.finished[i] {
+			fanOut++
+		}
+	}
+	if d.overBudget(pred, fanOut, logger) {
+		return
+	}
 
-	var Encodebuffer bytes.Buffer
-	enc := gob.NewEncoder(&Encodebuffer)
+	if d.Shadow != nil {
+		snap, err := snapshot(d.Generators)
+		if err != nil {
+			logger.Error("Failed to snapshot generators for shadow search", "error", err)
+		} else {
+			defer d.Shadow.compare(d, pred, snap, logger)
+		}
+	}
 
-	gob.Register(pred)
-	gob.Register(req.Gen)
+	if d.finished == nil {
+		d.finished = make([]bool, len(d.Generators))
+		d.opened = make([]bool, len(d.Generators))
+	}
+	if d.Sessions {
+		// the sessions of the last call have been closed, and a close may still be on its way
+		d.session = newRequestID(runID)
+	}
 
-	err := enc.Encode(req)
-	if err != nil {
-		log.Fatal("encode error", err)
+	ctx := d.Context
+	if ctx == nil {
+		ctx = context.Background()
+	}
+	ctx, span := Tracer().Start(ctx, "FindNext", trace.WithAttributes(graphAttributes(&d.H, d.Edges.Len())...))
+	defer span.End()
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel() // abandons the requests still in flight once the search has ended
+
+	dispatcher := d.Dispatcher
+	if dispatcher == nil {
+		dispatcher = DefaultDispatcher
 	}
-	// fmt.Println(Encodebuffer.Bytes())
 
-	// var decodedReq Request
-	// dec.Decode(&decodedReq)
+	pending := make(map[string]*chunk) // requests sent out, by their ID
+	w := newWaiter()                   // receives the messages for all requests of this call
+	var sent []string                  // all requests sent out, to be unregistered at the end
 
-	// fmt.Println("initial Graph", d.H.Edges.FullString())
-	// fmt.Println("decoded Graph", decodedReq.Subgraph.Edges.FullString())
+	defer func() {
+		close(w.done)
+		for _, id := range sent {
+			dispatcher.unregister(id)
+		}
 
-	// if !reflect.DeepEqual(decodedReq, req) {
-	// 	log.Panicln("decoding didn't produce equal request, ", req, decodedReq)
-	// }
+		// the search may never be continued, so the workers are not left holding its graph
+		for i := range d.Generators {
+			d.closeSession(ctx, dispatcher, runID, i, logger)
+		}
+	}()
+
+	var sendErr error // set if a request could neither be sent nor searched locally
+
+	// send publishes the current state of a generator as a new request, returning its ID. A
+	// request which cannot be published is answered in place of a worker, so that it is searched
+	// locally like one rejected by its worker.
+	send := func(index int, limit int) string {
+		req := Request{
+			Subgraph:  d.H,
+			Edges:     *d.Edges,
+			Predicate: pred,
+			Gen:       d.Generators[index],
+			BalFactor: d.BalFactor,
+			RunID:     runID,
+			ID:        newRequestID(runID),
+			Limit:     limit,
+		}
+		if d.Heartbeats != nil {
+			req.ProgressInterval = d.Heartbeats.Interval
+		}
+		if d.Sessions {
+			req.Session = d.sessionID(index)
+			if d.opened[index] {
+				req.Subgraph, req.Edges = lib.Graph{}, lib.Edges{} // held by the worker
+			}
+			d.opened[index] = true
+		}
+		reqLogger := logger.With("request", req.ID)
+		now := time.Now()
+		pending[req.ID] = &chunk{index: index, limit: limit, start: now, lastSeen: now, logger: reqLogger}
+		if dispatcher.untrusted() {
+			pending[req.ID].from = copyIterator(req.Gen)
+		}
 
-	ctx := context.Background()
+		data, err := EncodeRequest(req)
+		if err != nil {
+			masterErrors.WithLabelValues("encode").Inc()
+			reqLogger.Error("Encode error", "error", err)
+			sendErr = fmt.Errorf("encoding request %s: %v", req.ID, err)
+			return req.ID
+		}
 
-	// Sets your Google Cloud Platform project ID.
-	projectID := "hgtest-1"
+		reqLogger.Debug("Sending request", "bytes", len(data), "limit", req.Limit)
 
-	// fmt.Println("Creating a client.")
+		pubCtx, pubSpan := Tracer().Start(ctx, "publish")
+		attrs := injectTrace(pubCtx)
+		attrs[attrRequest] = req.ID
+		attrs[attrRun] = runID
+		if req.Session != "" {
+			attrs[attrSession] = req.Session
+		}
+		sign(attrs, data)
+		sent = append(sent, req.ID)
 
-	// Creates a client.
-	client, err := pubsub.NewClient(ctx, projectID)
-	if err != nil {
-		log.Fatalf("Failed to create client: %v", err)
+		err = dispatcher.send(ctx, req.ID, Message{Data: data, Attributes: attrs}, w)
+		pubSpan.End()
+		if err != nil {
+			masterErrors.WithLabelValues("publish").Inc()
+			reqLogger.Error("Publish failed", "error", err)
+
+			reply, replyAttrs, err := failure(req.ID, runID, fmt.Errorf("publish failed: %v", err))
+			if err != nil {
+				sendErr = err
+				return req.ID
+			}
+			w.put(Message{Data: reply, Attributes: replyAttrs})
+			return req.ID
+		}
+		requestsSent.Inc()
+		payloadBytes.WithLabelValues("request").Observe(float64(len(data)))
+		if d.Costs != nil {
+			d.Costs.AddRequest(len(data))
+		}
+
+		return req.ID
+	}
+
+	// drop removes a pending request, whose answer is no longer needed
+	drop := func(id string) {
+		delete(pending, id)
+		dispatcher.unregister(id)
+	}
+
+	// nextLimit sizes the next chunk
+	nextLimit := func() int {
+		if d.Chunks == nil {
+			return 0
+		}
+		return d.Chunks.Next(d.H.Edges.Len())
+	}
+
+	for i := range d.Generators {
+		if !d.finished[i] {
+			send(i, nextLimit())
+		}
+	}
+
+	var stopped bool              // true if the budget was exceeded while searching
+	var found bool                // true once a separator has been found
+	var latencies []time.Duration // of the requests answered so far
+
+	// the monitor checks the pending requests for stragglers and lost workers
+	var monitor <-chan time.Time
+	if d.Speculation != nil || d.Heartbeats != nil {
+		ticker := time.NewTicker(monitorInterval)
+		defer ticker.Stop()
+		monitor = ticker.C
 	}
-	defer client.Close()
 
-	// fmt.Println("Client created.")
+	logger.Debug("Waiting for solutions", "pending", len(pending))
+
+	for len(pending) > 0 && !found {
+		if sendErr != nil {
+			logger.Error("Request not sent", "error", sendErr)
+			d.fail(sendErr)
+			return
+		}
+
+		var msg Message
+
+		if w.queued() == 0 {
+			dispatcher.wait(w)
+		}
+
+		select {
+		case <-w.ready:
+			var ok bool
+			if msg, ok = w.next(); !ok {
+				continue
+			}
+		case <-ctx.Done():
+			logger.Warn("Search cancelled", "error", ctx.Err())
+			return
+		case <-monitor:
+			d.checkPending(pending, latencies, send, drop)
+			continue
+		}
+
+		if err := verify(msg.Attributes, msg.Data); err != nil {
+			masterErrors.WithLabelValues("corrupt").Inc()
+
+			// a corrupt progress report is simply skipped, while a solution has to be recomputed
+			id := msg.Attributes[attrRequest]
+			if c, ok := pending[id]; ok && !IsProgress(msg.Attributes) {
+				resumed := resume(pending, id, send, drop)
+				c.logger.Warn("Corrupt solution, resuming request", "resumed", resumed, "checked", c.checked)
+			} else {
+				logger.Warn("Dropping corrupt message", "received", id)
+			}
+			continue
+		}
+
+		if IsProgress(msg.Attributes) {
+			p, err := DecodeProgress(msg.Data)
+			if err != nil {
+				masterErrors.WithLabelValues("decode").Inc()
+				logger.Error("Decode error", "error", err, "bytes", len(msg.Data))
+				continue
+			}
+
+			c, ok := pending[p.ID]
+			if !ok {
+				continue
+			}
+			if dispatcher.untrusted() && !d.withinChunk(c, p.Gen) {
+				// the report is ignored, and the solution of the worker not trusted either
+				masterErrors.WithLabelValues("unverified").Inc()
+				c.logger.Error("Progress reported by worker is outside of the request", "worker", p.WorkerID)
+				c.misled = true
+				continue
+			}
+			progressReports.Inc()
+			c.lastSeen = time.Now()
+			c.checked = p.Candidates
+			d.Generators[c.index] = p.Gen
+
+			c.logger.Info("Progress", "worker", p.WorkerID, "candidates", p.Candidates, "elapsed", p.Elapsed)
+			continue
+		}
+
+		sol, err := DecodeSolution(msg.Data)
+		if err != nil {
+			masterErrors.WithLabelValues("decode").Inc()
+			id := msg.Attributes[attrRequest]
+			if _, ok := pending[id]; !ok {
+				logger.Warn("Dropping undecodable message", "received", id, "error", err, "bytes", len(msg.Data))
+				continue
+			}
+			sol = Solution{ID: id, Error: fmt.Sprintf("undecodable solution: %v", err)} // searched locally
+		}
+
+		c, ok := pending[sol.ID]
+		if !ok { // a duplicate, or the copy of a request which was already answered
+			continue
+		}
+
+		if sol.SessionLost {
+			// the worker was restarted, or it is not the one holding the session
+			sessionsLost.Inc()
+			d.opened[c.index] = false
+			resent := replace(pending, sol.ID, send, drop)
+			c.logger.Info("Session not held by worker, sending the graph again", "worker", sol.WorkerID,
+				"resent", resent)
+			continue
+		}
+
+		drop(sol.ID)
+		latencies = append(latencies, time.Since(c.start))
+
+		if _, ok := pending[c.twin]; ok { // the other copy has lost the race
+			drop(c.twin)
+		}
+
+		var reason string
+		switch {
+		case sol.Error != "":
+			// any other worker would reject the request as well
+			masterErrors.WithLabelValues("rejected").Inc()
+			reason = "Request rejected or not answered by a worker, searching it locally"
+		case c.misled:
+			reason = "Worker reported progress outside of the request, searching it locally"
+		case dispatcher.untrusted() && !d.withinChunk(c, sol.Gen):
+			masterErrors.WithLabelValues("unverified").Inc()
+			reason = "Generator sent back by worker is outside of the request, searching it locally"
+		case sol.Valid && dispatcher.untrusted() && !d.isSeparator(pred, sol.Selection):
+			masterErrors.WithLabelValues("unverified").Inc()
+			reason = "Selection sent back by worker is no separator, searching it locally"
+		}
+		if reason != "" {
+			c.logger.Error(reason, "error", sol.Error, "worker", sol.WorkerID, "selection", sol.Selection)
+			if sol, err = d.searchChunk(pred, c); err != nil {
+				c.logger.Error("Local search failed", "error", err)
+				d.fail(err)
+				return
+			}
+		}
+
+		extractTrace(ctx, msg.Attributes, "reply")
+		roundTrip.Observe(time.Since(c.start).Seconds())
+		payloadBytes.WithLabelValues("solution").Observe(float64(len(msg.Data)))
+		switch {
+		case sol.Valid:
+			solutionsReceived.WithLabelValues("valid").Inc()
+		case sol.LimitReached:
+			solutionsReceived.WithLabelValues("limit").Inc()
+		default:
+			solutionsReceived.WithLabelValues("exhausted").Inc()
+		}
+
+		c.logger.Info("Received solution", "valid", sol.Valid, "limit_reached", sol.LimitReached,
+			"worker", sol.WorkerID, "candidates", sol.Candidates, "round_trip", time.Since(c.start))
+
+		if d.Stats != nil {
+			d.Stats.Add(sol)
+		}
+		if d.Costs != nil {
+			d.Costs.AddSolution(len(msg.Data), sol)
+		}
+		if d.Chunks != nil {
+			d.Chunks.Observe(sol, d.H.Edges.Len())
+		}
 
-	// Sets the id for the new topic.
-	topicID := "workerTopic"
-	topic := client.Topic(topicID)
+		d.Generators[c.index] = sol.Gen // update the generator to keep track of progress
+
+		switch {
+		case sol.Valid:
+			d.Result = sol.Selection // set up the current result to the found value
+			found = true             // stop right after receiving the first separator
+		case !sol.LimitReached:
+			d.finished[c.index] = true
+			d.closeSession(ctx, dispatcher, runID, c.index, logger)
+		case d.Costs != nil && !d.Costs.Allows(1):
+			stopped = true
+		default:
+			send(c.index, nextLimit()) // continue with the next chunk
+		}
+	}
 
-	// topicID2 := "answerTopic"
-	// topic2 := client.Topic(topicID2)
+	// the generators of requests still pending keep their state from before (or from their
+	// last progress report), so the candidates of these are checked again by the next call
 
-	sub := client.Subscription("answerTopic-sub")
+	if len(d.Result) == 0 {
+		if stopped && d.overBudget(pred, 0, logger) {
+			return
+		}
+		d.ExhaustedSearch = true
+	}
+}
 
-	// sub, err := client.CreateSubscription(context.Background(), "testSub",
-	// 	pubsub.SubscriptionConfig{Topic: topic2})
-	// if err != nil {
-	// 	log.Println(err)
-	// }
+// resume replaces a pending request by a new one, continuing from its last reported position
+func resume(pending map[string]*chunk, id string, send func(index int, limit int) string,
+	drop func(id string)) string {
+	resumedRequests.Inc()
 
-	// if err != nil {
-	// 	log.Fatalf("Failed to create topic: %v", err)
-	// }
+	return replace(pending, id, send, drop)
+}
 
-	fmt.Println("writing to topic")
+// replace sends a pending request again as a new one, continuing from its last reported
+// position, and returns the ID of the new request
+func replace(pending map[string]*chunk, id string, send func(index int, limit int) string,
+	drop func(id string)) string {
+	c := pending[id]
+	drop(id)
+
+	resent := send(c.index, c.remaining())
+	if c.twin != "" {
+		pending[resent].twin = c.twin
+		if t, ok := pending[c.twin]; ok {
+			t.twin = resent
+		}
+	}
 
-	res := topic.Publish(ctx, &pubsub.Message{
-		Data: Encodebuffer.Bytes(),
-	})
+	return resent
+}
 
-	// The publish happens asynchronously.
+// sessionID returns the ID of the session holding the graph for the requests of a generator
+func (d *DistributedSearch) sessionID(index int) string {
+	return fmt.Sprintf("%s-%d", d.session, index)
+}
 
-	// Later, you can get the result from res:
+// closeSession tells the worker holding the session of a generator to forget it, once the
+// generator is exhausted or the search has ended. No answer is expected, a worker which misses it
+// closes the session once it needs the room.
+func (d *DistributedSearch) closeSession(ctx context.Context, dispatcher *Dispatcher, runID string,
+	index int, logger *Logger) {
+	if !d.Sessions || !d.opened[index] {
+		return
+	}
+	d.opened[index] = false
 
-	_, err = res.Get(ctx)
+	req := Request{ID: newRequestID(runID), RunID: runID, Session: d.sessionID(index), Close: true}
+	data, err := EncodeRequest(req)
 	if err != nil {
-		log.Fatal(err)
+		masterErrors.WithLabelValues("encode").Inc()
+		logger.Error("Encode error", "error", err)
+		return
 	}
 
-	var sol Solution
+	attrs := map[string]string{attrRequest: req.ID, attrRun: runID, attrSession: req.Session,
+		attrType: typeClose}
+	sign(attrs, data)
 
-	fmt.Println("Read something from sub")
+	if err = dispatcher.Transport.Send(ctx, Message{Data: data, Attributes: attrs}); err != nil {
+		masterErrors.WithLabelValues("publish").Inc()
+		logger.Warn("Failed to close session", "session", req.Session, "error", err)
+	}
+}
 
-	cctx, cancel := context.WithCancel(ctx)
-	err = sub.Receive(cctx, func(ctx context.Context, msg *pubsub.Message) {
+// checkPending resends the requests whose worker was lost, and speculatively those that straggle
+func (d *DistributedSearch) checkPending(pending map[string]*chunk, latencies []time.Duration,
+	send func(index int, limit int) string, drop func(id string)) {
+	if d.Heartbeats != nil {
+		for _, id := range d.Heartbeats.lost(pending) {
+			c := pending[id]
+			resumed := resume(pending, id, send, drop)
+			c.logger.Warn("Worker lost, resuming request", "resumed", resumed,
+				"checked", c.checked, "silent", time.Since(c.lastSeen))
+		}
+	}
 
-		buffer := bytes.NewBuffer(msg.Data)
-		dec := gob.NewDecoder(buffer)
+	if d.Speculation != nil {
+		for _, id := range d.Speculation.stragglers(pending, latencies) {
+			c := pending[id]
+			twin := send(c.index, c.limit)
+			c.twin = twin
+			pending[twin].twin = id
+
+			speculativeRequests.Inc()
+			if d.Stats != nil {
+				d.Stats.addSpeculative()
+			}
+			c.logger.Info("Resending straggling request", "copy", twin, "running", time.Since(c.start))
+		}
+	}
+}
 
-		gob.Register(req.ID)
+// overBudget returns true if the budget of the run does not allow sending the given number of
+// requests, in which case the search is either continued locally or aborted, depending on the
+// budget. An aborted search is marked as such, as it ended without being exhausted.
+func (d *DistributedSearch) overBudget(pred lib.Predicate, requests int, logger *Logger) bool {
+	if d.Costs == nil || d.Costs.Allows(requests) {
+		return false
+	}
 
-		err = dec.Decode(&sol)
+	if d.Costs.Budget.Fallback {
+		logger.Debug("Budget exceeded, searching locally")
+		d.Costs.addFallback()
+		d.searchLocally(pred)
+	} else {
+		logger.Error("Budget exceeded, aborting search")
+		d.Costs.addAbort()
+		d.Result = []int{}
+		d.ExhaustedSearch = true // ends the search, the algorithm cannot be told why
+		d.Aborted = true
+	}
 
-		if err != nil {
-			fmt.Println("received data, ", msg.Data)
-			log.Fatal("decode error 1:", err)
+	return true
+}
+
+// EncodeRequest serialises a Request, to be sent to the workers
+func EncodeRequest(req Request) ([]byte, error) {
+	if req.Predicate != nil { // not set on a message closing a session
+		gob.Register(req.Predicate)
+	}
+	if req.Gen != nil {
+		gob.Register(req.Gen)
+	}
+
+	var Encodebuffer bytes.Buffer
+	enc := gob.NewEncoder(&Encodebuffer)
+
+	err := enc.Encode(req)
+
+	return Encodebuffer.Bytes(), err
+}
+
+// DecodeSolution parses a Solution received by the master
+func DecodeSolution(data []byte) (sol Solution, err error) {
+	// the generator decodes itself, and is not hardened against malformed input
+	defer func() {
+		if r := recover(); r != nil {
+			sol, err = Solution{}, fmt.Errorf("decoding panicked: %v", r)
 		}
+	}()
 
-		if sol.ID != req.ID { // only acknowledge and cancel if message ID fits
-			fmt.Println("received message id,", sol.ID)
-			fmt.Println("Was expecting, ", req.ID)
-			return
+	dec := gob.NewDecoder(bytes.NewBuffer(data))
+	err = dec.Decode(&sol)
+
+	return sol, err
+}
+
+// searchLocally runs the search on this machine instead, using the parallel search of BalancedGo
+// on the same generators, so that the state of the search is kept
+func (d *DistributedSearch) searchLocally(pred lib.Predicate) {
+	local := lib.ParallelSearchGen{}.GetSearch(&d.H, d.Edges, d.BalFactor, d.Generators)
+	local.FindNext(pred)
+
+	d.Result = local.GetResult()
+	d.ExhaustedSearch = local.SearchEnded()
+}
+
+// searchChunk runs the search of a pending request in this process, continuing from its last
+// reported position
+func (d *DistributedSearch) searchChunk(pred lib.Predicate, c *chunk) (Solution, error) {
+	return Work(Request{
+		Subgraph:  d.H,
+		Edges:     *d.Edges,
+		Predicate: pred,
+		Gen:       d.Generators[c.index],
+		BalFactor: d.BalFactor,
+		Limit:     c.remaining(),
+	}, nil)
+}
+
+// isSeparator checks a selection sent back by a worker, which satisfies the predicate if the
+// worker is honest
+func (d *DistributedSearch) isSeparator(pred lib.Predicate, selection []int) bool {
+	if len(selection) == 0 {
+		return false
+	}
+	for _, i := range selection {
+		if i < 0 || i >= d.Edges.Len() {
+			return false
 		}
+	}
+	sep := lib.GetSubset(*d.Edges, selection)
 
-		msg.Ack()
+	return pred.Check(&d.H, &sep, d.BalFactor)
+}
+
+// withinChunk checks a generator sent back by a worker for the given chunk. It has to be valid
+// for the edges of the search, and lie between the generator sent and the last candidate the
+// chunk may check.
+func (d *DistributedSearch) withinChunk(c *chunk, generator lib.Generator) bool {
+	if c.from == nil || validateGenerator(generator, d.Edges.Len()) != nil {
+		return false
+	}
+	gen, from := generator.(*lib.CombinationIterator), c.from
+	if gen.OldK != from.OldK || gen.StepSize != from.StepSize || gen.Extended != from.Extended {
+		return false
+	}
+
+	// each candidate advances the generator by its step size, the last one is left unconfirmed
+	pos, start := position(gen), position(from)
+	if pos < start {
+		return false
+	}
 
-		cancel() // cancel right after receiving the first message
+	return c.limit <= 0 || pos <= start+float64(c.limit+1)*float64(from.StepSize)
+}
 
-	})
+// copyIterator returns a copy of a generator, which is not changed by searching the original, or
+// nil if it is no *lib.CombinationIterator
+func copyIterator(generator lib.Generator) *lib.CombinationIterator {
+	gen, ok := generator.(*lib.CombinationIterator)
+	if !ok || gen == nil {
+		return nil
+	}
+	cp := *gen
+	cp.Combination = append([]int(nil), gen.Combination...)
 
-	// if err = sub.Delete(ctx); err != nil {
-	// 	log.Println(err)
-	// }
+	return &cp
+}
 
-	d.Result = sol.Selection // set up the current result to the found value
+// position returns the number of combinations an iterator has passed, in the order it produces
+// them: from the largest size down to the current one, each in lexicographic order
+func position(gen *lib.CombinationIterator) float64 {
+	var pos float64
+	for k := gen.OldK; k > gen.K; k-- {
+		pos += binomial(gen.N, k)
+	}
 
-	// tmp := lib.GetSubset(*d.Edges, sol.Selection)
-	// fmt.Println("result is", tmp)
-	// fmt.Println("Vertices: ", tmp.Vertices())
+	prev := -1
+	for i, e := range gen.Combination {
+		for v := prev + 1; v < e; v++ {
+			pos += binomial(gen.N-1-v, gen.K-1-i) // combinations with v in place of e
+		}
+		prev = e
+	}
 
-	d.Generators[0] = sol.Gen // update the generator to keeep track of progress
+	return pos
+}
 
-	if len(d.Result) == 0 {
-		d.ExhaustedSearch = true
+// fail ends a search which cannot be completed. Like an aborted one, it is marked as exhausted,
+// as the algorithm cannot be told why it ended, and is counted in the statistics of the run.
+func (d *DistributedSearch) fail(err error) {
+	d.Result = []int{}
+	d.ExhaustedSearch = true
+	d.Err = err
+	if d.Stats != nil {
+		d.Stats.addFailure()
 	}
 }
 
 // SearchEnded returns true if search is completed
 func (d *DistributedSearch) SearchEnded() bool {
+	d.mux.Lock()
+	defer d.mux.Unlock()
+
 	return d.ExhaustedSearch
 }
 
 // GetResult returns the last found result
 func (d *DistributedSearch) GetResult() []int {
+	d.mux.Lock()
+	defer d.mux.Unlock()
+
 	return d.Result
 }
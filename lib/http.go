@@ -0,0 +1,369 @@
+package lib
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+// conflictPolls is the number of times a request still being searched by a worker under an
+// earlier attempt is POSTed there again, before it is sent to another worker
+const conflictPolls = 10
+
+// attrHeader prefixes the HTTP headers carrying the attributes of a message
+const attrHeader = "X-Ghd-"
+
+// setAttrHeaders adds the attributes of a message to HTTP headers
+func setAttrHeaders(h http.Header, attrs map[string]string) {
+	for k, v := range attrs {
+		h.Set(attrHeader+k, v)
+	}
+}
+
+// attrsFromHeaders returns the attributes carried by HTTP headers, all attribute names are in
+// lower case
+func attrsFromHeaders(h http.Header) map[string]string {
+	attrs := make(map[string]string)
+	for k := range h {
+		if len(k) > len(attrHeader) && strings.EqualFold(k[:len(attrHeader)], attrHeader) {
+			attrs[strings.ToLower(k[len(attrHeader):])] = h.Get(k)
+		}
+	}
+
+	return attrs
+}
+
+// ServeHTTP handles a request POSTed by an HTTPTransport, and replies with the encoded Solution
+// right away. The attributes of both are carried in headers. A request which is invalid is
+// answered with a Solution carrying the error, if its ID is known, and with a client error status
+// otherwise. Progress is not reported, as nothing can be sent before the Solution.
+func (w *Worker) ServeHTTP(rw http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(rw, "requests have to be POSTed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	body := r.Body
+	if w.Limits.MaxBytes > 0 {
+		body = http.MaxBytesReader(rw, r.Body, int64(w.Limits.MaxBytes))
+	}
+	data, err := ioutil.ReadAll(body)
+	if err != nil {
+		workerErrors.WithLabelValues("invalid").Inc()
+		http.Error(rw, err.Error(), http.StatusRequestEntityTooLarge)
+		return
+	}
+
+	out, attrs, err := w.Handle(r.Context(), data, attrsFromHeaders(r.Header), nil)
+	switch {
+	case err == ErrDuplicate:
+		http.Error(rw, err.Error(), http.StatusConflict)
+		return
+	case err == ErrNoReply:
+		rw.WriteHeader(http.StatusNoContent)
+		return
+	case err == ErrCorrupt || errors.Is(err, ErrInvalid):
+		http.Error(rw, err.Error(), http.StatusBadRequest)
+		return
+	case err != nil:
+		http.Error(rw, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	setAttrHeaders(rw.Header(), attrs)
+	rw.Header().Set("Content-Type", "application/octet-stream")
+	rw.Write(out)
+}
+
+// An HTTPTransport POSTs every request to one of a list of worker URLs, served by
+// Worker.ServeHTTP, and receives the Solution in the response. There is no answer topic, and no
+// progress is reported. A request which fails, with a network error or a server error, is sent
+// again, up to Retries times, after which it is answered with an error so that the master searches
+// it itself. A request rejected by the worker is answered with an error right away. The requests
+// of a session go to the URL which answered its first request, until a request fails there.
+//
+// A request which timed out may still be searched by its worker when it is sent again. The worker
+// answers with a conflict then, and the request is POSTed there again after a pause, until the
+// worker has the reply, or the request is sent to another worker after conflictPolls attempts.
+// The requests still in flight when their search ends are abandoned.
+type HTTPTransport struct {
+	URLs      []string
+	Balancing Balancing
+	Retries   int           // times a request is sent again after it failed
+	Timeout   time.Duration // of each POST, including the search, 0 for none, ignored if Client is set
+	Client    *http.Client  // optional, a client with the Timeout is used if not set
+	Logger    *Logger       // optional, DefaultLogger is used if not set
+
+	once     sync.Once
+	client   *http.Client
+	mux      sync.Mutex
+	inflight []int          // requests in flight, by URL
+	next     int            // the URL to try first on the next request
+	affinity map[string]int // the URL holding each session
+	messages chan Message
+	done     chan struct{} // closed by Close
+	closed   bool
+}
+
+// init sets up the transport, if that has not happened yet
+func (t *HTTPTransport) init() {
+	t.once.Do(func() {
+		t.client = t.Client
+		if t.client == nil {
+			t.client = &http.Client{Timeout: t.Timeout}
+		}
+		t.inflight = make([]int, len(t.URLs))
+		t.affinity = make(map[string]int)
+		t.messages = make(chan Message, 256)
+		t.done = make(chan struct{})
+	})
+}
+
+// logger returns the Logger of the transport
+func (t *HTTPTransport) logger() *Logger {
+	if t.Logger == nil {
+		return DefaultLogger
+	}
+
+	return t.Logger
+}
+
+// hold counts another request to a URL as in flight
+func (t *HTTPTransport) hold(i int) {
+	t.mux.Lock()
+	defer t.mux.Unlock()
+
+	t.inflight[i]++
+}
+
+// pick chooses the URL of a request following the balancing policy, or the URL holding its
+// session, and counts it as in flight
+func (t *HTTPTransport) pick(session string) int {
+	t.mux.Lock()
+	defer t.mux.Unlock()
+
+	if i, ok := t.affinity[session]; ok {
+		t.inflight[i]++
+		return i
+	}
+
+	best := t.next % len(t.URLs)
+	if t.Balancing == LeastLoaded {
+		for i := range t.URLs {
+			j := (t.next + i) % len(t.URLs)
+			if t.inflight[j] < t.inflight[best] {
+				best = j
+			}
+		}
+	}
+	t.next++
+	t.inflight[best]++
+	if session != "" {
+		t.affinity[session] = best
+	}
+
+	return best
+}
+
+// release counts a request to a URL as no longer in flight
+func (t *HTTPTransport) release(i int) {
+	t.mux.Lock()
+	defer t.mux.Unlock()
+
+	t.inflight[i]--
+}
+
+// forget stops sending the requests of a session to a URL, after a request failed there
+func (t *HTTPTransport) forget(session string, i int) {
+	t.mux.Lock()
+	defer t.mux.Unlock()
+
+	if j, ok := t.affinity[session]; ok && j == i {
+		delete(t.affinity, session)
+	}
+}
+
+// closeSession sends a message closing a session to the URL holding it, if any. It is not
+// answered, and if it fails the worker closes the session once it needs the room. As the search
+// of the session has ended, it is not bound to the context of the search.
+func (t *HTTPTransport) closeSession(msg Message) {
+	session := msg.Attributes[attrSession]
+
+	t.mux.Lock()
+	i, ok := t.affinity[session]
+	delete(t.affinity, session)
+	t.mux.Unlock()
+
+	if !ok {
+		return
+	}
+	if _, _, status, err := t.do(context.Background(), t.URLs[i], msg); err != nil || status != http.StatusNoContent {
+		t.logger().Debug("Failed to close session", "session", session, "status", status, "error", err)
+	}
+}
+
+// Send POSTs a request in the background, the response is passed on by Receive
+func (t *HTTPTransport) Send(ctx context.Context, msg Message) error {
+	t.init()
+	if len(t.URLs) == 0 {
+		return errors.New("no worker URLs")
+	}
+
+	t.mux.Lock()
+	closed := t.closed
+	t.mux.Unlock()
+	if closed {
+		return ErrClosed
+	}
+
+	if msg.Attributes[attrType] == typeClose {
+		go t.closeSession(msg)
+		return nil
+	}
+	go t.post(ctx, msg)
+
+	return nil
+}
+
+// post sends a request until a worker has answered it or it has failed too often. The request
+// is abandoned once ctx is done, as its search has ended.
+func (t *HTTPTransport) post(ctx context.Context, msg Message) {
+	id := msg.Attributes[attrRequest]
+	session := msg.Attributes[attrSession]
+	logger := t.logger().With("request", id)
+
+	poll := -1 // the URL to POST to again, while it is still searching the request
+	var polls int
+	delay := restartDelay
+
+	for attempt := 0; ; attempt++ {
+		i := poll
+		if i < 0 {
+			i = t.pick(session)
+		} else {
+			t.hold(i)
+		}
+		poll = -1
+		data, attrs, status, err := t.do(ctx, t.URLs[i], msg)
+		t.release(i)
+
+		var reason error
+		switch {
+		case err == nil && status == http.StatusOK:
+			t.deliver(Message{Data: data, Attributes: attrs})
+			return
+		case ctx.Err() != nil:
+			return
+		case err == nil && status == http.StatusConflict && polls < conflictPolls:
+			// the worker is still searching it under an earlier attempt, and keeps the reply
+			polls++
+			logger.Debug("Request still being searched, polling", "worker", t.URLs[i], "delay", delay)
+			select {
+			case <-ctx.Done():
+				return
+			case <-time.After(delay):
+			}
+			if delay *= 2; delay > maxReconnectDelay {
+				delay = maxReconnectDelay
+			}
+			poll = i
+			attempt-- // a poll is not a failed attempt
+			continue
+		case err == nil && status == http.StatusConflict:
+			reason = fmt.Errorf("still searched at %s after %d polls", t.URLs[i], polls)
+			polls = 0
+		case err == nil && status >= 400 && status < 500:
+			reason = fmt.Errorf("rejected by %s with status %d: %s", t.URLs[i], status, bytes.TrimSpace(data))
+			attempt = t.Retries // it would be rejected again
+		case err == nil:
+			reason = fmt.Errorf("failed at %s with status %d: %s", t.URLs[i], status, bytes.TrimSpace(data))
+		default:
+			reason = err
+		}
+
+		masterErrors.WithLabelValues("http").Inc()
+		t.forget(session, i)
+		if attempt < t.Retries {
+			logger.Warn("Request failed, sending it again", "error", reason, "attempt", attempt+1)
+			continue
+		}
+
+		logger.Error("Giving up on request", "error", reason)
+		data, attrs, err = failure(id, msg.Attributes[attrRun], reason)
+		if err != nil {
+			logger.Error("Encoding error", "error", err)
+			return
+		}
+		t.deliver(Message{Data: data, Attributes: attrs})
+		return
+	}
+}
+
+// do POSTs a request to a URL, returning the body, attributes and status of the response
+func (t *HTTPTransport) do(ctx context.Context, url string, msg Message) ([]byte, map[string]string, int, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, url, bytes.NewReader(msg.Data))
+	if err != nil {
+		return nil, nil, 0, err
+	}
+	req.Header.Set("Content-Type", "application/octet-stream")
+	setAttrHeaders(req.Header, msg.Attributes)
+
+	resp, err := t.client.Do(req)
+	if err != nil {
+		return nil, nil, 0, err
+	}
+	defer resp.Body.Close()
+
+	data, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, nil, 0, err
+	}
+
+	return data, attrsFromHeaders(resp.Header), resp.StatusCode, nil
+}
+
+// deliver passes a message on to Receive
+func (t *HTTPTransport) deliver(msg Message) {
+	select {
+	case t.messages <- msg:
+	case <-t.done:
+	}
+}
+
+// Receive passes on the responses of the workers. As the workers only ever reply to this master,
+// messages which handle does not accept are dropped.
+func (t *HTTPTransport) Receive(ctx context.Context, handle func(msg Message) bool) error {
+	t.init()
+
+	for {
+		select {
+		case msg := <-t.messages:
+			handle(msg)
+		case <-ctx.Done():
+			return nil
+		case <-t.done:
+			return nil
+		}
+	}
+}
+
+// Close stops passing on responses, the transport cannot be used afterwards
+func (t *HTTPTransport) Close() error {
+	t.init()
+
+	t.mux.Lock()
+	defer t.mux.Unlock()
+
+	if !t.closed {
+		t.closed = true
+		close(t.done)
+	}
+
+	return nil
+}
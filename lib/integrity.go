@@ -0,0 +1,41 @@
+package lib
+
+import (
+	"errors"
+	"fmt"
+	"hash/crc32"
+)
+
+// attribute carrying a checksum of the message data
+const attrChecksum = "crc32c"
+
+// ErrCorrupt is returned for a message whose data does not match its checksum
+var ErrCorrupt = errors.New("message data does not match its checksum")
+
+var castagnoli = crc32.MakeTable(crc32.Castagnoli)
+
+// checksum returns the checksum of some message data, as carried in the attributes
+func checksum(data []byte) string {
+	return fmt.Sprintf("%08x", crc32.Checksum(data, castagnoli))
+}
+
+// sign adds the checksum of the data to the attributes of a message
+func sign(attrs map[string]string, data []byte) map[string]string {
+	if attrs == nil {
+		attrs = make(map[string]string)
+	}
+	attrs[attrChecksum] = checksum(data)
+
+	return attrs
+}
+
+// verify checks the data of a message against its checksum. Messages without one, as sent by
+// older versions, are accepted.
+func verify(attrs map[string]string, data []byte) error {
+	sum, ok := attrs[attrChecksum]
+	if !ok || sum == checksum(data) {
+		return nil
+	}
+
+	return ErrCorrupt
+}
@@ -0,0 +1,181 @@
+package lib
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// A Level indicates the severity of a log entry
+type Level int
+
+// The supported log levels, in increasing order of severity
+const (
+	LevelDebug Level = iota
+	LevelInfo
+	LevelWarn
+	LevelError
+	LevelOff // disables all output
+)
+
+var levelNames = map[Level]string{
+	LevelDebug: "DEBUG",
+	LevelInfo:  "INFO",
+	LevelWarn:  "WARNING",
+	LevelError: "ERROR",
+}
+
+func (l Level) String() string {
+	return levelNames[l]
+}
+
+// ParseLevel turns a level name (debug, info, warn, error or off) into a Level
+func ParseLevel(s string) (Level, error) {
+	switch strings.ToLower(s) {
+	case "debug":
+		return LevelDebug, nil
+	case "info":
+		return LevelInfo, nil
+	case "warn", "warning":
+		return LevelWarn, nil
+	case "error":
+		return LevelError, nil
+	case "off":
+		return LevelOff, nil
+	}
+
+	return LevelOff, fmt.Errorf("unknown log level: %s", s)
+}
+
+// A Logger writes leveled log entries as JSON objects, one per line. The keys "severity" and
+// "message" follow the conventions of Cloud Logging. A nil Logger discards everything.
+type Logger struct {
+	out    io.Writer
+	mux    *sync.Mutex
+	level  Level
+	fields []interface{}
+}
+
+// NewLogger produces a Logger writing all entries of at least the given level to out
+func NewLogger(out io.Writer, level Level) *Logger {
+	return &Logger{out: out, mux: &sync.Mutex{}, level: level}
+}
+
+// DefaultLogger is used whenever no Logger has been provided
+var DefaultLogger = NewLogger(os.Stderr, LevelInfo)
+
+// With returns a Logger which adds the given key-value pairs to each entry
+func (l *Logger) With(kv ...interface{}) *Logger {
+	if l == nil {
+		return nil
+	}
+
+	out := *l
+	out.fields = append(append([]interface{}{}, l.fields...), kv...)
+
+	return &out
+}
+
+// Enabled returns true if entries of the given level are written
+func (l *Logger) Enabled(level Level) bool {
+	return l != nil && level >= l.level && level < LevelOff
+}
+
+// Debug logs a message, with additional key-value pairs, at level debug
+func (l *Logger) Debug(msg string, kv ...interface{}) { l.log(LevelDebug, msg, kv) }
+
+// Info logs a message, with additional key-value pairs, at level info
+func (l *Logger) Info(msg string, kv ...interface{}) { l.log(LevelInfo, msg, kv) }
+
+// Warn logs a message, with additional key-value pairs, at level warn
+func (l *Logger) Warn(msg string, kv ...interface{}) { l.log(LevelWarn, msg, kv) }
+
+// Error logs a message, with additional key-value pairs, at level error
+func (l *Logger) Error(msg string, kv ...interface{}) { l.log(LevelError, msg, kv) }
+
+// Fatal logs a message, with additional key-value pairs, at level error and exits the process.
+// The message is written even if the Logger discards errors, so that the process never exits
+// without a reason.
+func (l *Logger) Fatal(msg string, kv ...interface{}) {
+	if !l.Enabled(LevelError) {
+		l = NewLogger(os.Stderr, LevelError).With(l.fieldsOrNil()...)
+	}
+	l.log(LevelError, msg, kv)
+	os.Exit(1)
+}
+
+// fieldsOrNil returns the key-value pairs added to each entry, also for a nil Logger
+func (l *Logger) fieldsOrNil() []interface{} {
+	if l == nil {
+		return nil
+	}
+
+	return l.fields
+}
+
+// Writer returns a writer which logs each line written to it as a message at the given level,
+// such as the output of the standard logger
+func (l *Logger) Writer(level Level) io.Writer {
+	return logWriter{logger: l, level: level}
+}
+
+// logWriter passes the lines written to it on to a Logger
+type logWriter struct {
+	logger *Logger
+	level  Level
+}
+
+func (w logWriter) Write(b []byte) (int, error) {
+	for _, line := range strings.Split(string(b), "\n") {
+		if line = strings.TrimSpace(line); line != "" {
+			w.logger.log(w.level, line, nil)
+		}
+	}
+
+	return len(b), nil
+}
+
+func (l *Logger) log(level Level, msg string, kv []interface{}) {
+	if !l.Enabled(level) {
+		return
+	}
+
+	entry := make(map[string]interface{})
+	addFields(entry, l.fields)
+	addFields(entry, kv)
+	entry["time"] = time.Now().Format(time.RFC3339Nano)
+	entry["severity"] = level.String()
+	entry["message"] = msg
+
+	line, err := json.Marshal(entry)
+	if err != nil {
+		line = []byte(fmt.Sprintf(`{"severity":"ERROR","message":%q}`, err.Error()))
+	}
+
+	l.mux.Lock()
+	defer l.mux.Unlock()
+	l.out.Write(append(line, '\n'))
+}
+
+// addFields stores key-value pairs in the entry, values which cannot be
+// represented as JSON are replaced by their string representation
+func addFields(entry map[string]interface{}, kv []interface{}) {
+	for i := 0; i+1 < len(kv); i += 2 {
+		key := fmt.Sprint(kv[i])
+
+		switch v := kv[i+1].(type) {
+		case error:
+			entry[key] = v.Error()
+		case fmt.Stringer:
+			entry[key] = v.String()
+		case string, bool, int, int64, float64, []int, nil:
+			entry[key] = v
+		default:
+			entry[key] = fmt.Sprint(v)
+		}
+	}
+}
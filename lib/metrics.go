@@ -0,0 +1,149 @@
+package lib
+
+import (
+	"log"
+	"net/http"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+// metrics collected by the master, i.e. by FindNext
+
+var requestsSent = prometheus.NewCounter(prometheus.CounterOpts{
+	Namespace: "ghd",
+	Name:      "requests_sent_total",
+	Help:      "Number of requests published to the workers.",
+})
+
+var solutionsReceived = prometheus.NewCounterVec(prometheus.CounterOpts{
+	Namespace: "ghd",
+	Name:      "solutions_received_total",
+	Help:      "Number of solutions received from the workers, by outcome (valid, limit reached or exhausted).",
+}, []string{"outcome"})
+
+var roundTrip = prometheus.NewHistogram(prometheus.HistogramOpts{
+	Namespace: "ghd",
+	Name:      "round_trip_seconds",
+	Help:      "Time from publishing a request until its solution is received.",
+	Buckets:   prometheus.ExponentialBuckets(0.01, 2, 16),
+})
+
+var retries = prometheus.NewCounter(prometheus.CounterOpts{
+	Namespace: "ghd",
+	Name:      "retries_total",
+	Help:      "Number of messages that were delivered more than once.",
+})
+
+var speculativeRequests = prometheus.NewCounter(prometheus.CounterOpts{
+	Namespace: "ghd",
+	Name:      "speculative_requests_total",
+	Help:      "Number of straggling requests which were sent out a second time.",
+})
+
+var progressReports = prometheus.NewCounter(prometheus.CounterOpts{
+	Namespace: "ghd",
+	Name:      "progress_reports_total",
+	Help:      "Number of progress reports received from the workers.",
+})
+
+var resumedRequests = prometheus.NewCounter(prometheus.CounterOpts{
+	Namespace: "ghd",
+	Name:      "resumed_requests_total",
+	Help:      "Number of requests sent out again, as their worker stopped reporting progress.",
+})
+
+var sessionsLost = prometheus.NewCounter(prometheus.CounterOpts{
+	Namespace: "ghd",
+	Name:      "sessions_lost_total",
+	Help:      "Number of requests sent out again with the graph, as their worker did not hold the session.",
+})
+
+var masterErrors = prometheus.NewCounterVec(prometheus.CounterOpts{
+	Namespace: "ghd",
+	Name:      "master_errors_total",
+	Help:      "Number of errors on the master, by stage.",
+}, []string{"stage"})
+
+var offloadDecisions = prometheus.NewCounterVec(prometheus.CounterOpts{
+	Namespace: "ghd",
+	Name:      "offload_decisions_total",
+	Help:      "Number of searches, by whether they were run locally or distributed to the workers.",
+}, []string{"decision"})
+
+// metrics collected by the workers
+
+var workerRequests = prometheus.NewCounter(prometheus.CounterOpts{
+	Namespace: "ghd",
+	Name:      "worker_requests_total",
+	Help:      "Number of requests handled by this worker.",
+})
+
+var candidatesChecked = prometheus.NewHistogram(prometheus.HistogramOpts{
+	Namespace: "ghd",
+	Name:      "worker_candidates_checked",
+	Help:      "Number of candidate separators checked per request.",
+	Buckets:   prometheus.ExponentialBuckets(1, 4, 12),
+})
+
+var workerErrors = prometheus.NewCounterVec(prometheus.CounterOpts{
+	Namespace: "ghd",
+	Name:      "worker_errors_total",
+	Help:      "Number of errors on the worker, by stage.",
+}, []string{"stage"})
+
+// shared by both sides
+
+var duplicates = prometheus.NewCounterVec(prometheus.CounterOpts{
+	Namespace: "ghd",
+	Name:      "duplicates_total",
+	Help:      "Number of messages dropped or answered from cache as duplicates, by side (master or worker).",
+}, []string{"side"})
+
+var unroutedMessages = prometheus.NewCounter(prometheus.CounterOpts{
+	Namespace: "ghd",
+	Name:      "unrouted_messages_total",
+	Help:      "Number of messages received by the master for requests it never sent, e.g. of other runs on a shared subscription.",
+})
+
+var shadowDivergences = prometheus.NewCounterVec(prometheus.CounterOpts{
+	Namespace: "ghd",
+	Name:      "shadow_divergences_total",
+	Help:      "Number of distributed searches whose result differed from the local search, by kind (outcome or separator).",
+}, []string{"kind"})
+
+var payloadBytes = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+	Namespace: "ghd",
+	Name:      "payload_bytes",
+	Help:      "Size of the encoded messages, by kind (request or solution).",
+	Buckets:   prometheus.ExponentialBuckets(256, 4, 10),
+}, []string{"kind"})
+
+func init() {
+	prometheus.MustRegister(requestsSent, solutionsReceived, roundTrip, retries, speculativeRequests,
+		progressReports, resumedRequests, sessionsLost, masterErrors, offloadDecisions,
+		workerRequests, candidatesChecked, workerErrors, payloadBytes, duplicates,
+		unroutedMessages, shadowDivergences)
+}
+
+// CountRedelivery records a message which was delivered more than once
+func CountRedelivery() {
+	retries.Inc()
+}
+
+// ServeMetrics exposes all collected metrics on the /metrics endpoint of the given address,
+// running in the background. An empty address disables the endpoint.
+func ServeMetrics(addr string) {
+	if addr == "" {
+		return
+	}
+
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", promhttp.Handler())
+
+	go func() {
+		if err := http.ListenAndServe(addr, mux); err != nil {
+			log.Println("metrics endpoint stopped: ", err)
+		}
+	}()
+}
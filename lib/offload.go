@@ -0,0 +1,62 @@
+package lib
+
+import (
+	"github.com/cem-okulmus/BalancedGo/lib"
+)
+
+// binomial returns n choose k, as a float to avoid overflows for large search spaces
+func binomial(n, k int) float64 {
+	if k < 0 || n < k {
+		return 0
+	}
+	if k > n/2 {
+		k = n - k
+	}
+
+	b := 1.0
+	for i := 1; i <= k; i++ {
+		b = b * float64(n-k+i) / float64(i)
+	}
+
+	return b
+}
+
+// SearchSpace estimates the number of candidates the generators of a search will produce over
+// the given number of edges. Only combination iterators can be estimated, for any other kind of
+// generator the size of the search space is unknown and -1 is returned.
+func SearchSpace(edges int, gens []lib.Generator) float64 {
+	if len(gens) == 0 {
+		return 0
+	}
+
+	c, ok := gens[0].(*lib.CombinationIterator)
+	if !ok {
+		return -1
+	}
+
+	k := c.OldK
+	if k == 0 {
+		k = c.K
+	}
+	if !c.Extended {
+		return binomial(edges, k)
+	}
+
+	var output float64
+	for i := k; i >= 1; i-- {
+		output = output + binomial(edges, i)
+	}
+
+	return output
+}
+
+// EstimateWork estimates the effort needed for a search, as the size of its search space times
+// the size of the subgraph each candidate is checked against
+func EstimateWork(H *lib.Graph, edges *lib.Edges, gens []lib.Generator) float64 {
+	space := SearchSpace(edges.Len(), gens)
+	if space < 0 {
+		return -1
+	}
+
+	return space * float64(H.Edges.Len())
+}
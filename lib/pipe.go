@@ -0,0 +1,185 @@
+package lib
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"sync"
+	"time"
+)
+
+// restartDelay is the pause before a crashed worker process is started again
+const restartDelay = 100 * time.Millisecond
+
+// A PipeTransport runs the workers as subprocesses of the master, exchanging framed messages
+// over their standard input and output (see Worker.ServeStream). Each worker has its own heap, so
+// a panic or a memory blowup in one does not affect the master, and no network is needed.
+//
+// A worker process which exits is started again, and the requests it was working on are sent to
+// the other ones. A request which has crashed its worker more often than Retries is answered with
+// an error instead, so that the master searches it itself.
+type PipeTransport struct {
+	Command string   // the worker binary
+	Args    []string // arguments of the worker, which has to serve on its standard input and output
+	Workers int      // number of worker processes, at least one is started
+	Retries int      // times a request is sent again after its worker exited
+	Logger  *Logger  // optional, DefaultLogger is used if not set
+
+	once  sync.Once
+	err   error // of starting the workers
+	pool  *streamPool
+	mux   sync.Mutex
+	procs []*exec.Cmd // the running processes, by worker
+}
+
+// watchdogWriter writes to the standard input of a worker process, killing the process if a write
+// does not complete in time, as a worker which stopped reading would otherwise block the writer
+// for good
+type watchdogWriter struct {
+	w    io.Writer
+	proc *os.Process
+}
+
+func (d watchdogWriter) Write(b []byte) (int, error) {
+	watchdog := time.AfterFunc(writeTimeout, func() { d.proc.Kill() })
+	defer watchdog.Stop()
+
+	return d.w.Write(b)
+}
+
+// init starts the worker processes, if that has not happened yet
+func (p *PipeTransport) init() error {
+	p.once.Do(func() {
+		logger := p.Logger
+		if logger == nil {
+			logger = DefaultLogger
+		}
+
+		workers := p.Workers
+		if workers < 1 {
+			workers = 1
+		}
+		names := make([]string, workers)
+		for i := range names {
+			names[i] = fmt.Sprint(i)
+		}
+		p.pool = newStreamPool(names, LeastLoaded, p.Retries, logger)
+		p.procs = make([]*exec.Cmd, workers)
+
+		// a binary which cannot be started at all is reported right away
+		for i, s := range p.pool.streams {
+			stdout, err := p.start(i, s)
+			if err != nil {
+				p.err = err
+				return
+			}
+			go p.run(i, s, stdout)
+		}
+	})
+
+	return p.err
+}
+
+// start runs a worker process and makes its stream available
+func (p *PipeTransport) start(index int, s *poolStream) (io.Reader, error) {
+	cmd := exec.Command(p.Command, p.Args...)
+	cmd.Stderr = os.Stderr // the log of the worker
+
+	stdin, err := cmd.StdinPipe()
+	if err != nil {
+		return nil, err
+	}
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		return nil, err
+	}
+
+	p.mux.Lock()
+	defer p.mux.Unlock()
+
+	if p.pool.isClosed() {
+		return nil, ErrClosed
+	}
+	if err = cmd.Start(); err != nil {
+		return nil, fmt.Errorf("starting worker %q: %v", p.Command, err)
+	}
+	p.procs[index] = cmd
+
+	p.pool.logger.Debug("Started worker process", "worker", index, "pid", cmd.Process.Pid)
+	p.pool.up(s, watchdogWriter{w: stdin, proc: cmd.Process})
+
+	return stdout, nil
+}
+
+// run reads the messages of a worker process, and restarts it whenever it exits
+func (p *PipeTransport) run(index int, s *poolStream, stdout io.Reader) {
+	for {
+		p.pool.read(s, stdout)
+		p.pool.down(s)
+
+		p.mux.Lock()
+		cmd := p.procs[index]
+		p.mux.Unlock()
+		err := cmd.Wait()
+
+		if p.pool.isClosed() {
+			return
+		}
+		masterErrors.WithLabelValues("worker_exit").Inc()
+		p.pool.logger.Warn("Worker process exited, restarting it", "worker", index, "error", err)
+
+		for {
+			time.Sleep(restartDelay)
+
+			stdout, err = p.start(index, s)
+			if err == ErrClosed {
+				return
+			}
+			if err == nil {
+				break
+			}
+			p.pool.logger.Error("Failed to restart worker process", "worker", index, "error", err)
+		}
+	}
+}
+
+// Send writes a request to the worker process with the fewest requests in flight
+func (p *PipeTransport) Send(ctx context.Context, msg Message) error {
+	if err := p.init(); err != nil {
+		return err
+	}
+
+	return p.pool.send(msg)
+}
+
+// Receive passes on the messages of all worker processes. As the workers only ever reply to this
+// master, messages which handle does not accept are dropped.
+func (p *PipeTransport) Receive(ctx context.Context, handle func(msg Message) bool) error {
+	if err := p.init(); err != nil {
+		return err
+	}
+
+	return p.pool.receive(ctx, handle)
+}
+
+// Close stops all worker processes, the transport cannot be used afterwards
+func (p *PipeTransport) Close() error {
+	p.once.Do(func() { p.err = ErrClosed }) // nothing was started, and nothing will be
+
+	if p.pool == nil || !p.pool.close() {
+		return nil
+	}
+
+	p.mux.Lock()
+	defer p.mux.Unlock()
+
+	for _, cmd := range p.procs {
+		if cmd != nil {
+			cmd.Process.Kill() // the search of a request cannot be interrupted otherwise
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,346 @@
+package lib
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"io"
+	"sync"
+)
+
+// A Balancing policy picks the worker a request is sent to
+type Balancing int
+
+const (
+	// LeastLoaded picks the worker with the fewest requests in flight, taking turns among equals
+	LeastLoaded Balancing = iota
+	// RoundRobin picks the workers in turn
+	RoundRobin
+)
+
+// ParseBalancing converts the name of a policy, "leastLoaded" or "roundRobin", to a Balancing
+func ParseBalancing(name string) (Balancing, error) {
+	switch name {
+	case "leastLoaded":
+		return LeastLoaded, nil
+	case "roundRobin":
+		return RoundRobin, nil
+	}
+
+	return LeastLoaded, fmt.Errorf("unknown balancing policy %q", name)
+}
+
+// A streamPool spreads the requests of a Transport over a set of workers, each reached
+// through a framed stream (see Worker.ServeStream) which may break and come up again. It tracks
+// the requests in flight on each stream, and hands those of a broken stream to the others. A
+// request whose stream has broken more often than the retries is answered with an error, so that
+// the master searches it itself. The requests of a session go to the stream which received its
+// first request, as long as that stream is up. Each stream which is up has a goroutine writing
+// its requests, so that a slow worker does not hold up the others.
+type streamPool struct {
+	balancing Balancing
+	retries   int
+	logger    *Logger
+
+	mux      sync.Mutex
+	streams  []*poolStream
+	next     int                    // the stream to try first on the next send
+	queue    []*poolRequest         // requests waiting for any stream to come up
+	affinity map[string]*poolStream // the stream holding each session
+	messages chan Message           // sent back by all workers
+	done     chan struct{}          // closed by close
+	closed   bool
+}
+
+// a stream to a single worker
+type poolStream struct {
+	name     string
+	out      io.Writer // nil while the stream is down
+	inflight map[string]*poolRequest
+	frames   []Message     // waiting to be written to out
+	wake     chan struct{} // signals the writer of new frames
+	stop     chan struct{} // closed when the stream goes down, stopping its writer
+}
+
+// a request waiting for its solution
+type poolRequest struct {
+	id       string
+	msg      Message
+	attempts int // number of streams which broke while it was in flight
+}
+
+// newStreamPool produces a pool of streams with the given names, all of them down
+func newStreamPool(names []string, balancing Balancing, retries int, logger *Logger) *streamPool {
+	p := &streamPool{
+		balancing: balancing,
+		retries:   retries,
+		logger:    logger,
+		messages:  make(chan Message, 256),
+		done:      make(chan struct{}),
+		affinity:  make(map[string]*poolStream),
+	}
+	for _, name := range names {
+		p.streams = append(p.streams, &poolStream{name: name, inflight: make(map[string]*poolRequest)})
+	}
+
+	return p
+}
+
+// add creates a stream to a worker which has just joined, it is down until up is called
+func (p *streamPool) add(name string) *poolStream {
+	p.mux.Lock()
+	defer p.mux.Unlock()
+
+	s := &poolStream{name: name, inflight: make(map[string]*poolRequest)}
+	p.streams = append(p.streams, s)
+
+	return s
+}
+
+// remove forgets a stream to a worker which has left, after it was marked as down
+func (p *streamPool) remove(s *poolStream) {
+	p.mux.Lock()
+	defer p.mux.Unlock()
+
+	for session, other := range p.affinity {
+		if other == s {
+			delete(p.affinity, session)
+		}
+	}
+
+	for i := range p.streams {
+		if p.streams[i] == s {
+			p.streams = append(p.streams[:i], p.streams[i+1:]...)
+			return
+		}
+	}
+}
+
+// pick chooses an available stream following the balancing policy, or nil if all are down. The
+// lock must be held.
+func (p *streamPool) pick() *poolStream {
+	var best *poolStream
+	for i := range p.streams {
+		s := p.streams[(p.next+i)%len(p.streams)]
+		if s.out == nil {
+			continue
+		}
+		if best == nil {
+			best = s
+			if p.balancing == RoundRobin {
+				break
+			}
+		} else if len(s.inflight) < len(best.inflight) {
+			best = s
+		}
+	}
+	p.next++
+
+	return best
+}
+
+// assign writes a request to a stream, or queues it if no stream is up. A message closing a
+// session is only written to the stream holding the session, and it is not tracked, as it is not
+// answered. The lock must be held.
+func (p *streamPool) assign(r *poolRequest) {
+	session := r.msg.Attributes[attrSession]
+	if r.msg.Attributes[attrType] == typeClose {
+		if s, ok := p.affinity[session]; ok && s.out != nil {
+			s.queue(r.msg)
+		}
+		delete(p.affinity, session)
+		return
+	}
+
+	s := p.affinity[session]
+	if s == nil || s.out == nil {
+		s = p.pick()
+	}
+	if s == nil {
+		p.queue = append(p.queue, r)
+		return
+	}
+	if session != "" {
+		p.affinity[session] = s
+	}
+
+	s.inflight[r.id] = r
+	s.queue(r.msg)
+}
+
+// queue hands a message to the writer of the stream. The lock must be held.
+func (s *poolStream) queue(msg Message) {
+	s.frames = append(s.frames, msg)
+	select {
+	case s.wake <- struct{}{}:
+	default: // the writer has been woken up already
+	}
+}
+
+// write sends the queued messages to out, until the stream goes down or the pool is closed. The
+// requests of a stream which has just broken are handed on once that is noticed.
+func (p *streamPool) write(s *poolStream, out io.Writer, wake chan struct{}, stop chan struct{}) {
+	for {
+		select {
+		case <-wake:
+		case <-stop:
+			return
+		case <-p.done:
+			return
+		}
+
+		p.mux.Lock()
+		var frames []Message
+		if s.stop == stop { // not yet replaced by the next connection
+			frames, s.frames = s.frames, nil
+		}
+		p.mux.Unlock()
+
+		for _, msg := range frames {
+			if err := writeFrame(out, msg); err != nil {
+				p.logger.Debug("Failed to write request", "worker", s.name, "error", err)
+				break
+			}
+		}
+	}
+}
+
+// send hands a request to one of the workers
+func (p *streamPool) send(msg Message) error {
+	p.mux.Lock()
+	defer p.mux.Unlock()
+
+	if p.closed {
+		return ErrClosed
+	}
+	p.assign(&poolRequest{id: msg.Attributes[attrRequest], msg: msg})
+
+	return nil
+}
+
+// up makes a stream available, writing to out, and sends it the queued requests
+func (p *streamPool) up(s *poolStream, out io.Writer) {
+	p.mux.Lock()
+	defer p.mux.Unlock()
+
+	s.out = out
+	s.frames = nil
+	s.wake = make(chan struct{}, 1)
+	s.stop = make(chan struct{})
+	go p.write(s, out, s.wake, s.stop)
+
+	queue := p.queue
+	p.queue = nil
+	for _, r := range queue {
+		p.assign(r)
+	}
+}
+
+// read passes on the messages of a stream, until it cannot be read any more
+func (p *streamPool) read(s *poolStream, in io.Reader) {
+	reader := bufio.NewReader(in)
+	for {
+		msg, err := readFrame(reader)
+		if err != nil {
+			return
+		}
+
+		if !IsProgress(msg.Attributes) {
+			p.mux.Lock()
+			delete(s.inflight, msg.Attributes[attrRequest])
+			p.mux.Unlock()
+		}
+
+		select {
+		case p.messages <- msg:
+		case <-p.done:
+			return
+		}
+	}
+}
+
+// down marks a stream as broken, and hands its requests in flight to the other streams
+func (p *streamPool) down(s *poolStream) {
+	p.mux.Lock()
+	if s.out != nil {
+		close(s.stop)
+	}
+	s.out = nil
+	s.frames = nil // those still tracked are handed on below
+	inflight := s.inflight
+	s.inflight = make(map[string]*poolRequest)
+
+	if p.closed {
+		p.mux.Unlock()
+		return
+	}
+
+	var failed []Message
+	for _, r := range inflight {
+		r.attempts++
+		if r.attempts > p.retries {
+			failed = append(failed, p.failed(r))
+			continue
+		}
+		p.assign(r)
+	}
+	p.mux.Unlock()
+
+	for _, msg := range failed {
+		select {
+		case p.messages <- msg:
+		case <-p.done:
+			return
+		}
+	}
+}
+
+// failed produces the answer to a request which keeps breaking its streams
+func (p *streamPool) failed(r *poolRequest) Message {
+	reason := fmt.Errorf("worker lost %d times while searching", r.attempts)
+	p.logger.Error("Giving up on request", "request", r.id, "error", reason)
+
+	data, attrs, err := failure(r.id, r.msg.Attributes[attrRun], reason)
+	if err != nil {
+		p.logger.Error("Encoding error", "error", err)
+	}
+
+	return Message{Data: data, Attributes: attrs}
+}
+
+// receive passes on the messages of all streams. As the workers only ever reply to this master,
+// messages which handle does not accept are dropped.
+func (p *streamPool) receive(ctx context.Context, handle func(msg Message) bool) error {
+	for {
+		select {
+		case msg := <-p.messages:
+			handle(msg)
+		case <-ctx.Done():
+			return nil
+		case <-p.done:
+			return nil
+		}
+	}
+}
+
+// close stops the pool, returning false if it was already closed
+func (p *streamPool) close() bool {
+	p.mux.Lock()
+	defer p.mux.Unlock()
+
+	if p.closed {
+		return false
+	}
+	p.closed = true
+	close(p.done)
+
+	return true
+}
+
+// isClosed returns true once the pool has been closed
+func (p *streamPool) isClosed() bool {
+	p.mux.Lock()
+	defer p.mux.Unlock()
+
+	return p.closed
+}
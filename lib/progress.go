@@ -0,0 +1,86 @@
+package lib
+
+import (
+	"bytes"
+	"encoding/gob"
+	"fmt"
+	"time"
+
+	"github.com/cem-okulmus/BalancedGo/lib"
+)
+
+// message attributes used to tell the kinds of messages sent by the workers apart
+const (
+	attrType     = "type"
+	typeProgress = "progress" // messages without a type are solutions
+)
+
+// A Progress is sent periodically by a worker while it is searching, so the master can tell a
+// slow worker from a dead one, and resume the search where it was last reported
+type Progress struct {
+	ID         string        // the request this progress belongs to
+	WorkerID   string        // identifies the worker instance
+	Gen        lib.Generator // state of the generator, all candidates before it have been checked
+	Candidates int           // number of candidates produced so far
+	Elapsed    time.Duration // time spent searching so far
+}
+
+// Heartbeats configures the progress messages of the workers. A request whose worker has not
+// reported in time is considered lost, and is sent out again from the last reported position.
+type Heartbeats struct {
+	Interval time.Duration // how often the workers report their progress
+	Timeout  time.Duration // how long the master waits for a report, including the time spent queueing
+}
+
+// ProgressAttributes marks the attributes of an encoded Progress
+func ProgressAttributes(attrs map[string]string) map[string]string {
+	if attrs == nil {
+		attrs = make(map[string]string)
+	}
+	attrs[attrType] = typeProgress
+
+	return attrs
+}
+
+// IsProgress returns true if the attributes belong to a Progress, rather than a Solution
+func IsProgress(attrs map[string]string) bool {
+	return attrs[attrType] == typeProgress
+}
+
+// EncodeProgress serialises a Progress, to be sent to the master
+func EncodeProgress(p Progress) ([]byte, error) {
+	var Encodebuffer bytes.Buffer
+	enc := gob.NewEncoder(&Encodebuffer)
+
+	err := enc.Encode(p)
+
+	return Encodebuffer.Bytes(), err
+}
+
+// DecodeProgress parses a Progress received by the master
+func DecodeProgress(data []byte) (p Progress, err error) {
+	// the generator decodes itself, and is not hardened against malformed input
+	defer func() {
+		if r := recover(); r != nil {
+			p, err = Progress{}, fmt.Errorf("decoding panicked: %v", r)
+		}
+	}()
+
+	dec := gob.NewDecoder(bytes.NewBuffer(data))
+	err = dec.Decode(&p)
+
+	return p, err
+}
+
+// lost returns the IDs of the pending requests which have not reported in time
+func (h *Heartbeats) lost(pending map[string]*chunk) []string {
+	var output []string
+
+	for id, c := range pending {
+		if time.Since(c.lastSeen) > h.Timeout {
+			output = append(output, id)
+		}
+	}
+
+	return output
+}
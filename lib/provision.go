@@ -0,0 +1,142 @@
+package lib
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"cloud.google.com/go/pubsub"
+)
+
+// attribute carrying the run ID, so a master can subscribe to the messages of its own run only
+const attrRun = "run"
+
+// runSubscriptionExpiry removes a run subscription left behind by a master that crashed
+const runSubscriptionExpiry = 24 * time.Hour // the minimum allowed by Pub/Sub
+
+// A Topology names the topics and subscriptions connecting the master with the workers
+type Topology struct {
+	RequestTopic       string // the master publishes its requests to this topic
+	AnswerTopic        string // the workers publish their solutions and progress to this topic
+	WorkerSubscription string // optional, pulled by standalone workers from the request topic
+	AnswerSubscription string // optional, shared by the masters without a subscription of their own run
+}
+
+// DefaultTopology is the one assumed to exist if nothing is provisioned
+var DefaultTopology = Topology{
+	RequestTopic:       "workerTopic",
+	AnswerTopic:        "answerTopic",
+	WorkerSubscription: "workerTopic-sub",
+	AnswerSubscription: "answerTopic-sub",
+}
+
+// RunSubscription returns the ID of the answer subscription of a run
+func (t Topology) RunSubscription(runID string) string {
+	return t.AnswerTopic + "-" + runID
+}
+
+// RunFilter returns the filter expression selecting the messages of a run
+func RunFilter(runID string) string {
+	return fmt.Sprintf("attributes.%s = %q", attrRun, runID)
+}
+
+// EnsureTopics creates the topics of the topology, and the worker and answer subscriptions if
+// they are named, unless they exist already
+func (t Topology) EnsureTopics(ctx context.Context, client *pubsub.Client) error {
+	requests, err := ensureTopic(ctx, client, t.RequestTopic)
+	if err != nil {
+		return err
+	}
+	answers, err := ensureTopic(ctx, client, t.AnswerTopic)
+	if err != nil {
+		return err
+	}
+
+	if t.WorkerSubscription != "" {
+		err = ensureSubscription(ctx, client, t.WorkerSubscription, pubsub.SubscriptionConfig{Topic: requests})
+		if err != nil {
+			return err
+		}
+	}
+	if t.AnswerSubscription != "" {
+		return ensureSubscription(ctx, client, t.AnswerSubscription, pubsub.SubscriptionConfig{Topic: answers})
+	}
+
+	return nil
+}
+
+// Provision creates the topics of the topology if needed, and the answer subscription of a run
+// (see SubscribeRun)
+func (t Topology) Provision(ctx context.Context, client *pubsub.Client, runID string) (string, func(context.Context) error, error) {
+	if err := t.EnsureTopics(ctx, client); err != nil {
+		return "", nil, err
+	}
+
+	return t.SubscribeRun(ctx, client, runID)
+}
+
+// SubscribeRun creates a subscription on the answer topic with a server-side filter on the run
+// ID, so the master only receives the messages of its own run, and concurrent runs never share a
+// subscription. It returns the ID of the subscription, and a function deleting it once the run
+// is over. Messages without the run attribute, as sent by older workers, are filtered out.
+func (t Topology) SubscribeRun(ctx context.Context, client *pubsub.Client, runID string) (string, func(context.Context) error, error) {
+	subID := t.RunSubscription(runID)
+	sub, err := client.CreateSubscription(ctx, subID, pubsub.SubscriptionConfig{
+		Topic:            client.Topic(t.AnswerTopic),
+		Filter:           RunFilter(runID),
+		ExpirationPolicy: runSubscriptionExpiry,
+		Labels:           map[string]string{attrRun: runID},
+	})
+	if err != nil {
+		return "", nil, fmt.Errorf("creating subscription %s: %v", subID, err)
+	}
+
+	teardown := func(ctx context.Context) error {
+		return sub.Delete(ctx)
+	}
+
+	return subID, teardown, nil
+}
+
+// ensureTopic returns a topic, creating it if it does not exist
+func ensureTopic(ctx context.Context, client *pubsub.Client, id string) (*pubsub.Topic, error) {
+	topic := client.Topic(id)
+
+	ok, err := topic.Exists(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("checking topic %s: %v", id, err)
+	}
+	if ok {
+		return topic, nil
+	}
+
+	if _, err = client.CreateTopic(ctx, id); err != nil {
+		// another process may have created it in the meantime
+		if ok, _ := topic.Exists(ctx); !ok {
+			return nil, fmt.Errorf("creating topic %s: %v", id, err)
+		}
+	}
+
+	return topic, nil
+}
+
+// ensureSubscription creates a subscription if it does not exist
+func ensureSubscription(ctx context.Context, client *pubsub.Client, id string, cfg pubsub.SubscriptionConfig) error {
+	sub := client.Subscription(id)
+
+	ok, err := sub.Exists(ctx)
+	if err != nil {
+		return fmt.Errorf("checking subscription %s: %v", id, err)
+	}
+	if ok {
+		return nil
+	}
+
+	if _, err = client.CreateSubscription(ctx, id, cfg); err != nil {
+		if ok, _ := sub.Exists(ctx); !ok {
+			return fmt.Errorf("creating subscription %s: %v", id, err)
+		}
+	}
+
+	return nil
+}
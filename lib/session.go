@@ -0,0 +1,106 @@
+package lib
+
+import (
+	"errors"
+	"sync"
+	"time"
+
+	"github.com/cem-okulmus/BalancedGo/lib"
+)
+
+// attribute carrying the session of a request, so that a transport can send all requests of a
+// session to the same worker
+const attrSession = "session"
+
+// type of a message closing a session
+const typeClose = "close"
+
+// ErrNoReply is returned by a Worker for a message which is not answered, such as the closing of
+// a session
+var ErrNoReply = errors.New("message needs no reply")
+
+// maxSessions is the number of sessions a Worker holds, the least recently used one is closed to
+// make room for another
+const maxSessions = 64
+
+// A session holds the graph of a search on a worker, so that the requests of the search only
+// need to carry the state of their generator. The master opens a session by sending a request
+// with the graph and a session ID, and later requests of the same generator only carry the ID.
+// The session is closed by the master once the search has ended.
+type session struct {
+	subgraph lib.Graph
+	edges    lib.Edges
+	lastUsed time.Time
+}
+
+// sessionCache holds the sessions of a Worker, it is safe for concurrent use
+type sessionCache struct {
+	mux      sync.Mutex
+	sessions map[string]*session
+}
+
+// newSessionCache produces an empty sessionCache
+func newSessionCache() *sessionCache {
+	return &sessionCache{sessions: make(map[string]*session)}
+}
+
+// open stores the graph of a session, closing the least recently used one if there are too many
+func (c *sessionCache) open(id string, subgraph lib.Graph, edges lib.Edges) {
+	c.mux.Lock()
+	defer c.mux.Unlock()
+
+	if _, ok := c.sessions[id]; !ok && len(c.sessions) >= maxSessions {
+		var oldest string
+		for other, s := range c.sessions {
+			if oldest == "" || s.lastUsed.Before(c.sessions[oldest].lastUsed) {
+				oldest = other
+			}
+		}
+		delete(c.sessions, oldest)
+	}
+
+	c.sessions[id] = &session{subgraph: subgraph, edges: edges, lastUsed: time.Now()}
+}
+
+// get returns the session with the given ID, and whether it is held
+func (c *sessionCache) get(id string) (*session, bool) {
+	c.mux.Lock()
+	defer c.mux.Unlock()
+
+	s, ok := c.sessions[id]
+	if ok {
+		s.lastUsed = time.Now()
+	}
+
+	return s, ok
+}
+
+// close forgets a session
+func (c *sessionCache) close(id string) {
+	c.mux.Lock()
+	defer c.mux.Unlock()
+
+	delete(c.sessions, id)
+}
+
+// attach completes a request of a session with the graph held by the session, or stores the
+// graph if the request opens the session. It returns whether the graph was taken from the
+// session, and false for ok if the session is not held, in which case the request cannot be
+// searched.
+func (c *sessionCache) attach(request *Request) (cached bool, ok bool) {
+	if request.Session == "" {
+		return false, true
+	}
+
+	if request.Subgraph.Edges.Len() > 0 {
+		return false, true // opens the session, which is stored once the request is validated
+	}
+
+	s, ok := c.get(request.Session)
+	if !ok {
+		return false, false
+	}
+	request.Subgraph, request.Edges = s.subgraph, s.edges
+
+	return true, true
+}
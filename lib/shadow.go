@@ -0,0 +1,188 @@
+package lib
+
+import (
+	"bytes"
+	"encoding/gob"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sync"
+
+	"github.com/cem-okulmus/BalancedGo/lib"
+)
+
+// extension of the files requests are dumped to
+const requestExt = ".req"
+
+// Shadow runs a DistributedSearch in shadow mode: every result is computed a second time in this
+// process, starting from the same generator state, and any divergence is logged. As each generator
+// is searched on its own, the distributed result must be the first separator of one of them.
+// It is safe for concurrent use.
+type Shadow struct {
+	Dir string // optional, the requests of divergent searches are dumped here for replay
+
+	mux     sync.Mutex
+	summary ShadowSummary
+}
+
+// A ShadowSummary counts the searches compared in shadow mode
+type ShadowSummary struct {
+	Compared int // searches compared with the local search
+	Diverged int // searches whose outcome or separator differed
+	Dumped   int // requests written to the dump directory
+}
+
+// Summary returns the counts so far
+func (s *Shadow) Summary() ShadowSummary {
+	s.mux.Lock()
+	defer s.mux.Unlock()
+
+	return s.summary
+}
+
+// snapshot encodes the state of the generators before a search changes it
+func snapshot(gens []lib.Generator) ([][]byte, error) {
+	var output [][]byte
+
+	for _, gen := range gens {
+		var buffer bytes.Buffer
+		if err := gob.NewEncoder(&buffer).Encode(&gen); err != nil {
+			return nil, err
+		}
+		output = append(output, buffer.Bytes())
+	}
+
+	return output, nil
+}
+
+// restore decodes a generator from a snapshot
+func restore(data []byte) (lib.Generator, error) {
+	var gen lib.Generator
+	err := gob.NewDecoder(bytes.NewBuffer(data)).Decode(&gen)
+
+	return gen, err
+}
+
+// compare searches every generator of the snapshot locally, and checks the distributed result
+// against the first separators found
+func (s *Shadow) compare(d *DistributedSearch, pred lib.Predicate, snap [][]byte, logger *Logger) {
+	if len(d.Result) == 0 && !d.ExhaustedSearch {
+		return // the search was cancelled or aborted, there is nothing to compare
+	}
+
+	var firsts [][]int
+	for i := range snap {
+		gen, err := restore(snap[i])
+		if err != nil {
+			logger.Error("Failed to restore generator for shadow search", "error", err)
+			return
+		}
+
+		// the same loop the workers run, without a limit on the candidates
+		sol, err := Work(Request{
+			Subgraph:  d.H,
+			Edges:     *d.Edges,
+			Predicate: pred,
+			Gen:       gen,
+			BalFactor: d.BalFactor,
+		}, nil)
+		if err != nil {
+			logger.Error("Shadow search failed", "error", err)
+			return
+		}
+		if sol.Valid {
+			firsts = append(firsts, sol.Selection)
+		}
+	}
+
+	var kind string
+	found := len(d.Result) > 0
+	switch {
+	case found != (len(firsts) > 0):
+		kind = "outcome"
+	case found && !containsSelection(firsts, d.Result):
+		kind = "separator"
+	}
+
+	s.mux.Lock()
+	s.summary.Compared++
+	if kind != "" {
+		s.summary.Diverged++
+	}
+	s.mux.Unlock()
+
+	if kind == "" {
+		logger.Debug("Shadow search agrees", "found", found)
+		return
+	}
+
+	shadowDivergences.WithLabelValues(kind).Inc()
+	logger.Error("Shadow search diverged", "kind", kind, "distributed", d.Result,
+		"exhausted", d.ExhaustedSearch, "local", firsts)
+
+	if s.Dir != "" {
+		s.dump(d, pred, snap, logger)
+	}
+}
+
+// dump writes one request per generator of the snapshot, as they were sent out at the start of
+// the divergent search
+func (s *Shadow) dump(d *DistributedSearch, pred lib.Predicate, snap [][]byte, logger *Logger) {
+	if err := os.MkdirAll(s.Dir, 0755); err != nil {
+		logger.Error("Failed to create dump directory", "error", err, "dir", s.Dir)
+		return
+	}
+
+	runID := d.RunID
+	if runID == "" {
+		runID = processRunID
+	}
+
+	for i := range snap {
+		gen, err := restore(snap[i])
+		if err != nil {
+			logger.Error("Failed to restore generator for dump", "error", err)
+			return
+		}
+
+		req := Request{
+			Subgraph:  d.H,
+			Edges:     *d.Edges,
+			Predicate: pred,
+			Gen:       gen,
+			BalFactor: d.BalFactor,
+			RunID:     runID,
+			ID:        fmt.Sprintf("%s-shadow-%d", newRequestID(runID), i),
+		}
+
+		data, err := EncodeRequest(req)
+		if err != nil {
+			logger.Error("Failed to encode request for dump", "error", err)
+			return
+		}
+
+		file := filepath.Join(s.Dir, req.ID+requestExt)
+		if err = ioutil.WriteFile(file, data, 0644); err != nil {
+			logger.Error("Failed to dump request", "error", err, "file", file)
+			return
+		}
+
+		s.mux.Lock()
+		s.summary.Dumped++
+		s.mux.Unlock()
+		logger.Info("Dumped request of divergent search", "file", file)
+	}
+}
+
+// containsSelection returns true if the selection is one of the given ones
+func containsSelection(selections [][]int, selection []int) bool {
+	for _, s := range selections {
+		if reflect.DeepEqual(s, selection) {
+			return true
+		}
+	}
+
+	return false
+}
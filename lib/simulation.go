@@ -0,0 +1,279 @@
+package lib
+
+import (
+	"container/heap"
+	"context"
+	"math"
+	"math/rand"
+	"os"
+	"sync"
+	"time"
+)
+
+// A LatencyModel describes the timing of a deployment of the workers, as charged in virtual time
+// by a SimTransport
+type LatencyModel struct {
+	Workers         int           // maximal number of worker instances running at once, 0 for no limit
+	Publish         time.Duration // time for a message to reach the other side
+	ColdStart       time.Duration // median time to start a new worker instance
+	ColdStartSpread float64       // spread of the log-normal distribution of cold starts, 0 for none
+	KeepWarm        time.Duration // an instance idle for longer starts cold again, 0 to keep it forever
+	CheckCost       time.Duration // compute time per candidate and edge of the subgraph
+}
+
+// DefaultLatencyModel roughly follows measurements of Cloud Functions triggered by Pub/Sub
+var DefaultLatencyModel = LatencyModel{
+	Workers:         100,
+	Publish:         20 * time.Millisecond,
+	ColdStart:       time.Second,
+	ColdStartSpread: 0.5,
+	KeepWarm:        15 * time.Minute,
+	CheckCost:       2 * time.Microsecond,
+}
+
+// A SimSummary reports the projection of a simulated run
+type SimSummary struct {
+	Elapsed     time.Duration // projected wall-clock time spent waiting for the workers
+	Requests    int           // requests handled by the simulated workers
+	ColdStarts  int           // requests which had to wait for a new instance
+	ColdTime    time.Duration // time spent starting instances
+	Busy        time.Duration // compute time, summed over all instances
+	Instances   int           // number of instances started
+	Utilization float64       // fraction of the elapsed time the started instances spent computing
+}
+
+// A SimTransport runs the real worker logic in process, but charges virtual time for publishing,
+// starting instances and checking candidates, following a LatencyModel. The workers' statistics
+// are rewritten to virtual time, so that chunk sizing and cost estimates follow the model.
+//
+// Messages are only delivered while a search is waiting for them, in the order of their virtual
+// arrival, so a run with the same seed and model always produces the same result and projection,
+// as long as its searches run one at a time. Concurrent searches also depend on the order in
+// which they happen to send their requests.
+// As real time plays no part, heartbeats and speculation do not work with a SimTransport.
+// The worker logic runs for at most Model.Workers requests at once, those of concurrent searches
+// wait for a free slot.
+type SimTransport struct {
+	Model  LatencyModel
+	Seed   int64
+	Worker *Worker // optional, a quiet worker is used if not set
+
+	once      sync.Once
+	slots     chan struct{} // one per simulated instance, nil for no limit
+	mux       sync.Mutex
+	rng       *rand.Rand
+	now       time.Duration // virtual time of the master
+	instances []*simInstance
+	queue     simQueue // replies in order of arrival at the master
+	sequence  int      // breaks ties between replies arriving at the same time
+	summary   SimSummary
+}
+
+// a simulated worker instance, handling one request at a time
+type simInstance struct {
+	free time.Duration // virtual time from which on the instance is idle
+}
+
+// a reply on its way to the master
+type simReply struct {
+	msg      Message
+	arrival  time.Duration
+	sequence int
+}
+
+// simQueue orders the replies by their virtual arrival
+type simQueue []simReply
+
+func (q simQueue) Len() int { return len(q) }
+func (q simQueue) Less(i, j int) bool {
+	if q[i].arrival != q[j].arrival {
+		return q[i].arrival < q[j].arrival
+	}
+	return q[i].sequence < q[j].sequence
+}
+func (q simQueue) Swap(i, j int)       { q[i], q[j] = q[j], q[i] }
+func (q *simQueue) Push(x interface{}) { *q = append(*q, x.(simReply)) }
+func (q *simQueue) Pop() interface{} {
+	old := *q
+	x := old[len(old)-1]
+	*q = old[:len(old)-1]
+	return x
+}
+
+// init sets up the random source and the worker, the lock must be held
+func (s *SimTransport) init() {
+	s.once.Do(func() {
+		s.rng = rand.New(rand.NewSource(s.Seed))
+		if s.Worker == nil {
+			s.Worker = NewWorker(NewLogger(os.Stderr, LevelWarn))
+		}
+		if s.Model.Workers > 0 {
+			s.slots = make(chan struct{}, s.Model.Workers)
+		}
+	})
+}
+
+// coldStart draws the time to start a new instance, the lock must be held
+func (s *SimTransport) coldStart() time.Duration {
+	if s.Model.ColdStartSpread <= 0 {
+		return s.Model.ColdStart
+	}
+
+	return time.Duration(float64(s.Model.ColdStart) * math.Exp(s.Model.ColdStartSpread*s.rng.NormFloat64()))
+}
+
+// assign picks the instance handling a request arriving at the given time, returning the time
+// at which it can start computing, the lock must be held
+func (s *SimTransport) assign(arrival time.Duration) (*simInstance, time.Duration) {
+	var best *simInstance
+	for _, in := range s.instances {
+		if best == nil || in.free < best.free {
+			best = in
+		}
+	}
+
+	full := s.Model.Workers > 0 && len(s.instances) >= s.Model.Workers
+	if best != nil && (best.free <= arrival || full) {
+		start := arrival
+		if best.free > start {
+			start = best.free
+		}
+		if s.Model.KeepWarm > 0 && start-best.free > s.Model.KeepWarm {
+			cold := s.coldStart()
+			s.summary.ColdStarts++
+			s.summary.ColdTime += cold
+			start += cold
+		}
+		return best, start
+	}
+
+	// all instances are busy, and another one may still be started
+	cold := s.coldStart()
+	s.summary.ColdStarts++
+	s.summary.ColdTime += cold
+	s.summary.Instances++
+
+	in := &simInstance{}
+	s.instances = append(s.instances, in)
+
+	return in, arrival + cold
+}
+
+// Send hands a request to a simulated worker instance, which computes the reply right away,
+// charging virtual time for it
+func (s *SimTransport) Send(ctx context.Context, msg Message) error {
+	s.mux.Lock()
+	s.init()
+	s.mux.Unlock()
+
+	data, attrs, err := s.handle(ctx, msg)
+	if err == ErrDuplicate || err == ErrNoReply {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	sol, err := DecodeSolution(data)
+	if err != nil {
+		return err
+	}
+
+	edges := 1
+	if req, err := DecodeRequest(msg.Data); err == nil && req.Subgraph.Edges.Len() > 0 {
+		edges = req.Subgraph.Edges.Len()
+	}
+	compute := time.Duration(sol.Candidates*edges) * s.Model.CheckCost
+
+	s.mux.Lock()
+	defer s.mux.Unlock()
+
+	in, start := s.assign(s.now + s.Model.Publish)
+	in.free = start + compute
+
+	s.summary.Requests++
+	s.summary.Busy += compute
+
+	// the statistics sent back are those of the model, not of this process
+	sol.WallTime = compute
+	sol.CPUTime = compute
+	if data, err = EncodeSolution(sol); err != nil {
+		return err
+	}
+	sign(attrs, data)
+
+	s.sequence++
+	heap.Push(&s.queue, simReply{
+		msg:      Message{Data: data, Attributes: attrs},
+		arrival:  in.free + s.Model.Publish,
+		sequence: s.sequence,
+	})
+
+	return nil
+}
+
+// handle runs the worker logic on a request, once one of the simulated instances is free
+func (s *SimTransport) handle(ctx context.Context, msg Message) ([]byte, map[string]string, error) {
+	if s.slots != nil {
+		select {
+		case s.slots <- struct{}{}:
+		case <-ctx.Done():
+			return nil, nil, ctx.Err()
+		}
+		defer func() { <-s.slots }()
+	}
+
+	return s.Worker.Handle(ctx, msg.Data, msg.Attributes, nil)
+}
+
+// Receive does nothing, the replies are delivered when a search waits for them (see idle)
+func (s *SimTransport) Receive(ctx context.Context, handle func(msg Message) bool) error {
+	<-ctx.Done()
+
+	return nil
+}
+
+// Close does nothing, as there is no connection to release
+func (s *SimTransport) Close() error {
+	return nil
+}
+
+// idle delivers the replies in the order of their arrival, advancing the virtual time of the
+// master to the arrival of each one which reached a waiting search. It returns once the calling
+// search has received a message, or all replies have been delivered. As concurrent searches
+// share the queue, the replies delivered here may be those of the other searches.
+func (s *SimTransport) idle(deliver func(Message) bool, ready func() bool) {
+	for !ready() {
+		s.mux.Lock()
+		if s.queue.Len() == 0 {
+			s.mux.Unlock()
+			return // the reply of the caller is being delivered by another search
+		}
+		r := heap.Pop(&s.queue).(simReply)
+		s.mux.Unlock()
+
+		if !deliver(r.msg) {
+			continue // the search no longer waits for this one
+		}
+
+		s.mux.Lock()
+		if r.arrival > s.now {
+			s.now = r.arrival
+		}
+		s.mux.Unlock()
+	}
+}
+
+// Summary returns the projection of the run so far
+func (s *SimTransport) Summary() SimSummary {
+	s.mux.Lock()
+	defer s.mux.Unlock()
+
+	out := s.summary
+	out.Elapsed = s.now
+	if out.Instances > 0 && s.now > 0 {
+		out.Utilization = float64(out.Busy) / (float64(out.Instances) * float64(s.now))
+	}
+
+	return out
+}
@@ -0,0 +1,50 @@
+package lib
+
+import (
+	"sort"
+	"time"
+)
+
+// monitorInterval is how often the pending requests are checked for stragglers and lost workers
+const monitorInterval = 100 * time.Millisecond
+
+// Speculation configures the speculative re-execution of straggling requests. Once most requests
+// of a FindNext have been answered, any request that runs much longer than the median is sent out
+// a second time, possibly reaching a different worker, and whichever copy answers first is used.
+type Speculation struct {
+	Quantile float64 // fraction of requests which must be answered before speculating, e.g. 0.75
+	Multiple float64 // a request straggles once it runs longer than this multiple of the median latency
+}
+
+// median returns the median of some latencies
+func median(latencies []time.Duration) time.Duration {
+	sorted := make([]time.Duration, len(latencies))
+	copy(sorted, latencies)
+	sort.Slice(sorted, func(i, j int) bool { return sorted[i] < sorted[j] })
+
+	return sorted[len(sorted)/2]
+}
+
+// stragglers returns the IDs of the pending requests which should be sent out again
+func (s *Speculation) stragglers(pending map[string]*chunk, latencies []time.Duration) []string {
+	if len(latencies) == 0 {
+		return nil
+	}
+	if float64(len(latencies)) < s.Quantile*float64(len(latencies)+len(pending)) {
+		return nil
+	}
+
+	limit := time.Duration(s.Multiple * float64(median(latencies)))
+
+	var output []string
+	for id, c := range pending {
+		if c.twin != "" { // already has a copy, or is one
+			continue
+		}
+		if time.Since(c.start) > limit {
+			output = append(output, id)
+		}
+	}
+
+	return output
+}
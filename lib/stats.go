@@ -0,0 +1,92 @@
+package lib
+
+import (
+	"sync"
+	"time"
+)
+
+// A StatsSummary contains the execution statistics of the workers, aggregated over a run
+type StatsSummary struct {
+	Solutions   int            // number of solutions received
+	Candidates  int            // candidates produced by the generators of all workers
+	Checks      int            // predicate checks performed by all workers
+	WallTime    time.Duration  // time spent searching, summed over all workers
+	CPUTime     time.Duration  // CPU time consumed, summed over all workers
+	CachedGraph int            // number of solutions for which the worker had the graph cached
+	Workers     map[string]int // number of solutions sent by each worker instance
+
+	LocalSearches  int // searches run locally, as they were below the offload threshold
+	RemoteSearches int // searches distributed to the workers
+	Speculative    int // straggling requests which were sent out a second time
+	Failed         int // searches which failed, making the result incomplete
+}
+
+// RunStats aggregates the execution statistics reported by the workers over an entire run,
+// to judge whether distributing the search pays off. It is safe for concurrent use.
+type RunStats struct {
+	mux     sync.Mutex
+	summary StatsSummary
+}
+
+// Add records the statistics of a single solution
+func (r *RunStats) Add(sol Solution) {
+	r.mux.Lock()
+	defer r.mux.Unlock()
+
+	s := &r.summary
+	if s.Workers == nil {
+		s.Workers = make(map[string]int)
+	}
+
+	s.Solutions++
+	s.Candidates += sol.Candidates
+	s.Checks += sol.Checks
+	s.WallTime += sol.WallTime
+	s.CPUTime += sol.CPUTime
+	if sol.GraphCached {
+		s.CachedGraph++
+	}
+	s.Workers[sol.WorkerID]++
+}
+
+// addDecision records whether a search was run locally or distributed
+func (r *RunStats) addDecision(local bool) {
+	r.mux.Lock()
+	defer r.mux.Unlock()
+
+	if local {
+		r.summary.LocalSearches++
+	} else {
+		r.summary.RemoteSearches++
+	}
+}
+
+// addSpeculative records a straggling request which was sent out again
+func (r *RunStats) addSpeculative() {
+	r.mux.Lock()
+	defer r.mux.Unlock()
+
+	r.summary.Speculative++
+}
+
+// addFailure records a search which failed
+func (r *RunStats) addFailure() {
+	r.mux.Lock()
+	defer r.mux.Unlock()
+
+	r.summary.Failed++
+}
+
+// Summary returns a copy of the statistics collected so far
+func (r *RunStats) Summary() StatsSummary {
+	r.mux.Lock()
+	defer r.mux.Unlock()
+
+	out := r.summary
+	out.Workers = make(map[string]int)
+	for k, v := range r.summary.Workers {
+		out.Workers[k] = v
+	}
+
+	return out
+}
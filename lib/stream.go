@@ -0,0 +1,122 @@
+package lib
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/binary"
+	"encoding/gob"
+	"fmt"
+	"io"
+	"sync"
+)
+
+// maxFrame bounds the size of a frame read from a stream, so a corrupted length cannot make the
+// reader allocate without limit. It leaves room for the attributes of the largest request.
+var maxFrame = uint32(DefaultLimits.MaxBytes + 1<<20)
+
+// writeFrame writes a message to a stream: the length of the encoded message as 4 bytes in big
+// endian order, followed by the gob encoded Message
+func writeFrame(w io.Writer, msg Message) error {
+	var buffer bytes.Buffer
+	buffer.Write(make([]byte, 4)) // room for the length
+	if err := gob.NewEncoder(&buffer).Encode(msg); err != nil {
+		return err
+	}
+
+	frame := buffer.Bytes()
+	binary.BigEndian.PutUint32(frame, uint32(len(frame)-4))
+
+	_, err := w.Write(frame)
+
+	return err
+}
+
+// readFrame reads a message written by writeFrame, returning io.EOF at the end of the stream
+func readFrame(r io.Reader) (Message, error) {
+	var msg Message
+
+	var header [4]byte
+	if _, err := io.ReadFull(r, header[:]); err != nil {
+		return msg, err
+	}
+
+	size := binary.BigEndian.Uint32(header[:])
+	if size > maxFrame {
+		return msg, fmt.Errorf("frame of %d bytes exceeds the limit of %d", size, maxFrame)
+	}
+
+	frame := make([]byte, size)
+	if _, err := io.ReadFull(r, frame); err != nil {
+		if err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+		return msg, err
+	}
+
+	err := gob.NewDecoder(bytes.NewReader(frame)).Decode(&msg)
+
+	return msg, err
+}
+
+// ServeStream reads framed requests from in and writes the replies and progress reports to out,
+// until in is closed or a frame cannot be read. Requests are handled concurrently, and the ones
+// still running are completed before returning. A request which cannot be handled, such as a
+// corrupted one, is answered with an error if its ID is known, so the master searches it itself.
+// This is the loop of a worker connected to the master by a pipe or a socket.
+func (w *Worker) ServeStream(ctx context.Context, in io.Reader, out io.Writer) error {
+	var mux sync.Mutex // the frames of concurrent requests must not interleave
+	write := func(data []byte, attrs map[string]string) error {
+		mux.Lock()
+		defer mux.Unlock()
+
+		return writeFrame(out, Message{Data: data, Attributes: attrs})
+	}
+
+	var wg sync.WaitGroup
+	defer wg.Wait()
+
+	reader := bufio.NewReader(in)
+	for {
+		msg, err := readFrame(reader)
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+
+			emit := func(data []byte, attrs map[string]string) {
+				if err := write(data, attrs); err != nil {
+					w.Logger.Warn("Failed to send progress", "error", err)
+				}
+			}
+
+			data, attrs, err := w.Handle(ctx, msg.Data, msg.Attributes, emit)
+			if err == ErrDuplicate || err == ErrNoReply {
+				return // the other delivery will reply, if any reply is needed
+			}
+			if err != nil {
+				w.Logger.Error("Failed to handle request", "error", err, "bytes", len(msg.Data))
+
+				// the master would otherwise wait for the reply, and can search the request itself
+				id := msg.Attributes[attrRequest]
+				if id == "" {
+					return
+				}
+				if data, attrs, err = failure(id, msg.Attributes[attrRun], err); err != nil {
+					w.Logger.Error("Encoding error", "error", err)
+					return
+				}
+			}
+
+			if err = write(data, attrs); err != nil {
+				w.Logger.Error("Failed to send solution", "error", err)
+			}
+		}()
+	}
+}
@@ -0,0 +1,184 @@
+package lib
+
+import (
+	"context"
+	"net"
+	"sync"
+	"time"
+)
+
+const (
+	dialTimeout       = 10 * time.Second // to establish a connection to a worker
+	writeTimeout      = 30 * time.Second // to write a request, after which the connection is dropped
+	maxReconnectDelay = 10 * time.Second // between attempts to reach a worker
+)
+
+// A TCPTransport keeps a connection to each of a list of workers serving with Worker.ServeTCP,
+// and exchanges framed messages with them. A connection which drops is established again, with
+// the requests in flight on it sent to the other workers. A request which has been in flight on
+// a dropped connection more often than Retries is answered with an error instead, so that the
+// master searches it itself. Requests sent while no worker is reachable wait for one.
+type TCPTransport struct {
+	Addrs     []string // host:port of the workers
+	Balancing Balancing
+	Retries   int     // times a request is sent again after its connection dropped
+	Logger    *Logger // optional, DefaultLogger is used if not set
+
+	once  sync.Once
+	pool  *streamPool
+	mux   sync.Mutex
+	conns []net.Conn // the open connections, by worker
+}
+
+// deadlineWriter writes to a connection, dropping it if a write does not complete in time, as a
+// partly written frame leaves the stream unusable
+type deadlineWriter struct {
+	conn net.Conn
+}
+
+func (d deadlineWriter) Write(b []byte) (int, error) {
+	d.conn.SetWriteDeadline(time.Now().Add(writeTimeout))
+
+	n, err := d.conn.Write(b)
+	if err != nil {
+		d.conn.Close()
+	}
+
+	return n, err
+}
+
+// init starts connecting to the workers, if that has not happened yet
+func (t *TCPTransport) init() {
+	t.once.Do(func() {
+		logger := t.Logger
+		if logger == nil {
+			logger = DefaultLogger
+		}
+
+		t.pool = newStreamPool(t.Addrs, t.Balancing, t.Retries, logger)
+		t.conns = make([]net.Conn, len(t.Addrs))
+		for i, s := range t.pool.streams {
+			go t.run(i, s)
+		}
+	})
+}
+
+// run keeps a connection to a worker, reading its messages and reconnecting when it drops
+func (t *TCPTransport) run(index int, s *poolStream) {
+	logger := t.pool.logger.With("worker", s.name)
+	delay := restartDelay
+
+	for {
+		conn, err := net.DialTimeout("tcp", s.name, dialTimeout)
+		if err != nil {
+			logger.Warn("Failed to connect to worker", "error", err, "retry", delay)
+
+			select {
+			case <-t.pool.done:
+				return
+			case <-time.After(delay):
+			}
+			if delay *= 2; delay > maxReconnectDelay {
+				delay = maxReconnectDelay
+			}
+			continue
+		}
+		delay = restartDelay
+
+		t.mux.Lock()
+		if t.pool.isClosed() {
+			t.mux.Unlock()
+			conn.Close()
+			return
+		}
+		t.conns[index] = conn
+		t.mux.Unlock()
+
+		logger.Debug("Connected to worker")
+		t.pool.up(s, deadlineWriter{conn: conn})
+		t.pool.read(s, conn)
+		t.pool.down(s)
+		conn.Close()
+
+		if t.pool.isClosed() {
+			return
+		}
+		masterErrors.WithLabelValues("connection").Inc()
+		logger.Warn("Connection to worker lost, reconnecting")
+	}
+}
+
+// Send writes a request to one of the connected workers, chosen following the Balancing
+func (t *TCPTransport) Send(ctx context.Context, msg Message) error {
+	t.init()
+
+	return t.pool.send(msg)
+}
+
+// Receive passes on the messages of all workers. As the workers only ever reply to this master,
+// messages which handle does not accept are dropped.
+func (t *TCPTransport) Receive(ctx context.Context, handle func(msg Message) bool) error {
+	t.init()
+
+	return t.pool.receive(ctx, handle)
+}
+
+// Close drops all connections, the transport cannot be used afterwards
+func (t *TCPTransport) Close() error {
+	t.init()
+	if !t.pool.close() {
+		return nil
+	}
+
+	t.mux.Lock()
+	defer t.mux.Unlock()
+
+	for _, conn := range t.conns {
+		if conn != nil {
+			conn.Close()
+		}
+	}
+
+	return nil
+}
+
+// ServeTCP accepts connections from masters on the listener, and serves each of them with
+// ServeStream, until ctx is done
+func (w *Worker) ServeTCP(ctx context.Context, listener net.Listener) error {
+	go func() {
+		<-ctx.Done()
+		listener.Close()
+	}()
+
+	for {
+		conn, err := listener.Accept()
+		if err != nil {
+			if ctx.Err() != nil {
+				return nil
+			}
+			return err
+		}
+
+		go func() {
+			logger := w.Logger.With("master", conn.RemoteAddr().String())
+			logger.Info("Master connected")
+
+			// a connection still open at shutdown is dropped, the master sends its requests elsewhere
+			stop := make(chan struct{})
+			defer close(stop)
+			go func() {
+				select {
+				case <-ctx.Done():
+					conn.Close()
+				case <-stop:
+				}
+			}()
+
+			if err := w.ServeStream(ctx, conn, conn); err != nil && ctx.Err() == nil {
+				logger.Warn("Connection failed", "error", err)
+			}
+			conn.Close()
+			logger.Info("Master disconnected")
+		}()
+	}
+}
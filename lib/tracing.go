@@ -0,0 +1,219 @@
+package lib
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/cem-okulmus/BalancedGo/lib"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/exporters/stdout/stdouttrace"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	semconv "go.opentelemetry.io/otel/semconv/v1.17.0"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// message attributes used to measure the time a message spent in a queue
+const (
+	attrPublished = "published" // unix nanoseconds at which the message was published
+)
+
+// Tracer returns the tracer used for all spans of the distributed search
+func Tracer() trace.Tracer {
+	return otel.Tracer("github.com/cem-okulmus/GHDDistributedSearch")
+}
+
+// SetupTracing installs a global tracer provider, exporting all spans to the given exporter,
+// and returns a function which flushes and stops the exporter. Supported exporters are
+// "stdout" and "file:<path>"; an empty string leaves tracing disabled.
+func SetupTracing(exporter string, service string) (func(), error) {
+	if exporter == "" {
+		return func() {}, nil
+	}
+
+	var w io.Writer
+	var f *os.File
+
+	switch {
+	case exporter == "stdout":
+		w = os.Stdout
+	case len(exporter) > 5 && exporter[:5] == "file:":
+		var err error
+		f, err = os.Create(exporter[5:])
+		if err != nil {
+			return nil, err
+		}
+		w = f
+	default:
+		return nil, fmt.Errorf("unknown trace exporter: %s", exporter)
+	}
+
+	exp, err := stdouttrace.New(stdouttrace.WithWriter(w))
+	if err != nil {
+		return nil, err
+	}
+
+	tp := sdktrace.NewTracerProvider(
+		sdktrace.WithSyncer(exp), // export right away, workers might be frozen between requests
+		sdktrace.WithResource(resource.NewSchemaless(semconv.ServiceName(service))),
+	)
+	otel.SetTracerProvider(tp)
+	otel.SetTextMapPropagator(propagation.TraceContext{})
+
+	return func() {
+		tp.Shutdown(context.Background())
+		if f != nil {
+			f.Close()
+		}
+	}, nil
+}
+
+// injectTrace writes the trace context of ctx, together with the current time, into a new
+// map of message attributes
+func injectTrace(ctx context.Context) map[string]string {
+	attrs := make(map[string]string)
+	otel.GetTextMapPropagator().Inject(ctx, propagation.MapCarrier(attrs))
+	attrs[attrPublished] = strconv.FormatInt(time.Now().UnixNano(), 10)
+
+	return attrs
+}
+
+// extractTrace returns the context carried by some message attributes, and records the time
+// the message spent in transit as a span with the given name
+func extractTrace(ctx context.Context, attrs map[string]string, name string) context.Context {
+	if attrs == nil {
+		return ctx
+	}
+	ctx = otel.GetTextMapPropagator().Extract(ctx, propagation.MapCarrier(attrs))
+
+	if published, err := strconv.ParseInt(attrs[attrPublished], 10, 64); err == nil {
+		_, span := Tracer().Start(ctx, name, trace.WithTimestamp(time.Unix(0, published)))
+		span.End()
+	}
+
+	return ctx
+}
+
+// graphAttributes describes the size of a subproblem, to be attached to spans
+func graphAttributes(H *lib.Graph, edges int) []attribute.KeyValue {
+	return []attribute.KeyValue{
+		attribute.Int("subgraph.edges", H.Edges.Len()),
+		attribute.Int("subgraph.vertices", len(H.Vertices())),
+		attribute.Int("allowed.edges", edges),
+	}
+}
+
+// Subproblems groups the searches of a decomposition into one span per subproblem, nested along
+// the recursion of the algorithm. As the algorithms of BalancedGo only pass the subgraph to the
+// search, the parent of a subproblem is taken to be the smallest subproblem seen so far whose
+// vertices include those of the new one. It is safe for concurrent use.
+type Subproblems struct {
+	ctx  context.Context // of the decomposition
+	mux  sync.Mutex
+	seen []*subproblem
+}
+
+// a subproblem of the decomposition, with its span
+type subproblem struct {
+	owner    *Subproblems
+	vertices map[int]bool
+	edges    int
+	special  int
+	depth    int
+	ctx      context.Context
+	span     trace.Span
+	lastUsed time.Time
+}
+
+// NewSubproblems produces the span tree of a decomposition, whose span is carried by ctx
+func NewSubproblems(ctx context.Context) *Subproblems {
+	return &Subproblems{ctx: ctx}
+}
+
+// contains returns true if the vertices of the subproblem include all vertices of another one
+func (s *subproblem) contains(vertices map[int]bool) bool {
+	if len(vertices) > len(s.vertices) {
+		return false
+	}
+	for v := range vertices {
+		if !s.vertices[v] {
+			return false
+		}
+	}
+
+	return true
+}
+
+// start returns the subproblem H, starting its span if H has not been seen before. Searches
+// started with the context of the subproblem become children of its span.
+func (p *Subproblems) start(H *lib.Graph, edges int) *subproblem {
+	vertices := make(map[int]bool)
+	for _, v := range H.Vertices() {
+		vertices[v] = true
+	}
+
+	p.mux.Lock()
+	defer p.mux.Unlock()
+
+	var parent *subproblem
+	for _, s := range p.seen {
+		if !s.contains(vertices) {
+			continue
+		}
+		if len(s.vertices) == len(vertices) && s.edges == H.Edges.Len() && s.special == len(H.Special) {
+			s.lastUsed = time.Now()
+			return s // another search of the same subproblem
+		}
+		if parent == nil || len(s.vertices) < len(parent.vertices) {
+			parent = s
+		}
+	}
+
+	ctx, depth := p.ctx, 0
+	if parent != nil {
+		ctx, depth = parent.ctx, parent.depth+1
+	}
+	attrs := append(graphAttributes(H, edges), attribute.Int("subproblem.depth", depth))
+	ctx, span := Tracer().Start(ctx, "subproblem", trace.WithAttributes(attrs...))
+
+	s := &subproblem{
+		owner:    p,
+		vertices: vertices,
+		edges:    H.Edges.Len(),
+		special:  len(H.Special),
+		depth:    depth,
+		ctx:      ctx,
+		span:     span,
+		lastUsed: time.Now(),
+	}
+	p.seen = append(p.seen, s)
+
+	return s
+}
+
+// touch records that a search of the subproblem has just run
+func (s *subproblem) touch() {
+	s.owner.mux.Lock()
+	defer s.owner.mux.Unlock()
+
+	s.lastUsed = time.Now()
+}
+
+// End ends the spans of all subproblems, each at the time its last search returned, to be
+// called once the decomposition is done
+func (p *Subproblems) End() {
+	p.mux.Lock()
+	defer p.mux.Unlock()
+
+	for _, s := range p.seen {
+		s.span.End(trace.WithTimestamp(s.lastUsed))
+	}
+	p.seen = nil
+}
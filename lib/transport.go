@@ -0,0 +1,121 @@
+package lib
+
+import (
+	"context"
+	"errors"
+	"sync"
+
+	"cloud.google.com/go/pubsub"
+	"google.golang.org/api/option"
+)
+
+// A Transport carries the encoded requests to the workers, and their messages back to the master.
+// A Transport is created once per process and reused by all searches.
+type Transport interface {
+	// Send delivers a request to the workers, returning once it has been accepted
+	Send(ctx context.Context, msg Message) error
+
+	// Receive passes every message sent back by the workers to handle, until ctx is done or
+	// receiving fails. Messages for which handle returns false are delivered again later.
+	Receive(ctx context.Context, handle func(msg Message) bool) error
+
+	// Close flushes any outstanding requests and releases all connections
+	Close() error
+}
+
+// ErrClosed is returned when sending through a Transport which has been closed
+var ErrClosed = errors.New("transport closed")
+
+// PubSubTransport publishes the requests to a Pub/Sub topic, and pulls the messages of the
+// workers from a subscription. The client is created on first use and kept until Close.
+type PubSubTransport struct {
+	ProjectID      string
+	TopicID        string                  // topic the requests are published to
+	SubscriptionID string                  // subscription the answers are pulled from
+	Settings       *pubsub.PublishSettings // optional, tunes the batching of the requests
+	Options        []option.ClientOption   // optional, e.g. to connect to a fake server in tests
+
+	mux    sync.Mutex
+	client *pubsub.Client
+	topic  *pubsub.Topic
+}
+
+// connect creates the client and topic, if that has not happened yet
+func (p *PubSubTransport) connect() (*pubsub.Client, *pubsub.Topic, error) {
+	p.mux.Lock()
+	defer p.mux.Unlock()
+
+	if p.client != nil {
+		return p.client, p.topic, nil
+	}
+
+	// the client outlives any single search, so it must not be bound to the context of one
+	client, err := pubsub.NewClient(context.Background(), p.ProjectID, p.Options...)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	topic := client.Topic(p.TopicID)
+	if p.Settings != nil {
+		topic.PublishSettings = *p.Settings
+	}
+
+	p.client, p.topic = client, topic
+
+	return client, topic, nil
+}
+
+// Send publishes a request and waits until the server has accepted it
+func (p *PubSubTransport) Send(ctx context.Context, msg Message) error {
+	_, topic, err := p.connect()
+	if err != nil {
+		return err
+	}
+
+	res := topic.Publish(ctx, &pubsub.Message{
+		Data:       msg.Data,
+		Attributes: msg.Attributes,
+	})
+
+	_, err = res.Get(ctx)
+
+	return err
+}
+
+// Receive pulls from the subscription, acknowledging the messages accepted by handle
+func (p *PubSubTransport) Receive(ctx context.Context, handle func(msg Message) bool) error {
+	client, _, err := p.connect()
+	if err != nil {
+		return err
+	}
+
+	sub := client.Subscription(p.SubscriptionID)
+
+	return sub.Receive(ctx, func(ctx context.Context, msg *pubsub.Message) {
+		if msg.DeliveryAttempt != nil && *msg.DeliveryAttempt > 1 {
+			CountRedelivery()
+		}
+
+		if handle(Message{Data: msg.Data, Attributes: msg.Attributes}) {
+			msg.Ack()
+		} else {
+			msg.Nack()
+		}
+	})
+}
+
+// Close flushes the topic and closes the client, a later use connects again
+func (p *PubSubTransport) Close() error {
+	p.mux.Lock()
+	defer p.mux.Unlock()
+
+	if p.client == nil {
+		return nil
+	}
+
+	p.topic.Stop()
+	err := p.client.Close()
+	p.client, p.topic = nil, nil
+
+	return err
+}
@@ -0,0 +1,222 @@
+package lib
+
+import (
+	"bytes"
+	"encoding/gob"
+	"errors"
+	"fmt"
+	"io"
+
+	"github.com/cem-okulmus/BalancedGo/lib"
+)
+
+// ErrInvalid is returned for a request which cannot or must not be searched by a worker
+var ErrInvalid = errors.New("invalid request")
+
+// Limits bound the requests a worker accepts, so that a malformed or oversized message cannot
+// exhaust its memory. A limit of 0 is not enforced.
+type Limits struct {
+	MaxBytes    int // size of the encoded request
+	MaxEdges    int // edges of the subgraph, and edges to choose from
+	MaxVertices int // distinct vertices of the subgraph and of the edges to choose from
+}
+
+// DefaultLimits allow for any request fitting into a Pub/Sub message
+var DefaultLimits = Limits{
+	MaxBytes:    10 << 20,
+	MaxEdges:    100000,
+	MaxVertices: 1000000,
+}
+
+// DecodeRequest parses a Request from the byte slice received by a worker, enforcing the
+// DefaultLimits
+func DecodeRequest(data []byte) (Request, error) {
+	return DefaultLimits.DecodeRequest(data)
+}
+
+// DecodeUnchecked parses a Request without enforcing any limits or validating it, for requests
+// from a trusted source, such as those captured before the workers validated requests. The search
+// of a request which is not valid may fail.
+func DecodeUnchecked(data []byte) (Request, error) {
+	return Limits{}.decode(data)
+}
+
+// DecodeRequest parses a Request and validates it against the limits. The returned error wraps
+// ErrInvalid if the data could not be decoded or the request is not valid.
+func (l Limits) DecodeRequest(data []byte) (Request, error) {
+	request, err := l.decode(data)
+	if err != nil {
+		return request, err
+	}
+
+	return request, l.Validate(request)
+}
+
+// edgeCount receives the number of edges of an encoded lib.Edges, without decoding the edges
+type edgeCount int
+
+// GobDecode counts the edges into a slice of empty structs, which takes no memory
+func (c *edgeCount) GobDecode(data []byte) error {
+	var edges []struct{}
+	if err := gob.NewDecoder(bytes.NewReader(data)).Decode(&edges); err != nil {
+		return err
+	}
+	*c = edgeCount(len(edges))
+
+	return nil
+}
+
+// requestSize receives the identity and the number of edges of an encoded Request, the other
+// fields are skipped
+type requestSize struct {
+	ID       string
+	RunID    string
+	Subgraph struct {
+		Edges   edgeCount
+		Special []edgeCount
+	}
+	Edges edgeCount
+}
+
+// reader returns the data as a reader, bounded by MaxBytes
+func (l Limits) reader(data []byte) io.Reader {
+	if l.MaxBytes <= 0 {
+		return bytes.NewReader(data)
+	}
+
+	return &io.LimitedReader{R: bytes.NewReader(data), N: int64(l.MaxBytes)}
+}
+
+// decode parses a Request within the limits, without validating it otherwise. An edge takes
+// far more memory than its encoding, so the edges are counted in a first pass, and the request
+// is only decoded if their numbers are within MaxEdges. A request rejected by the first pass
+// only carries its IDs.
+func (l Limits) decode(data []byte) (request Request, err error) {
+	if l.MaxBytes > 0 && len(data) > l.MaxBytes {
+		return request, fmt.Errorf("%w: %d bytes, at most %d allowed", ErrInvalid, len(data), l.MaxBytes)
+	}
+
+	// the types of BalancedGo decode themselves, and are not hardened against malformed input
+	defer func() {
+		if r := recover(); r != nil {
+			request, err = Request{}, fmt.Errorf("%w: decoding panicked: %v", ErrInvalid, r)
+		}
+	}()
+
+	if l.MaxEdges > 0 {
+		var size requestSize
+		if err = gob.NewDecoder(l.reader(data)).Decode(&size); err != nil {
+			return request, fmt.Errorf("%w: %v", ErrInvalid, err)
+		}
+
+		request = Request{ID: size.ID, RunID: size.RunID}
+		counts := []edgeCount{size.Edges, size.Subgraph.Edges, edgeCount(len(size.Subgraph.Special))}
+		for _, count := range append(counts, size.Subgraph.Special...) {
+			if int(count) > l.MaxEdges {
+				return request, fmt.Errorf("%w: %d edges, at most %d allowed", ErrInvalid, count, l.MaxEdges)
+			}
+		}
+		request = Request{}
+	}
+
+	dec := gob.NewDecoder(l.reader(data))
+	if err = dec.Decode(&request); err != nil {
+		return request, fmt.Errorf("%w: %v", ErrInvalid, err)
+	}
+
+	return request, nil
+}
+
+// Validate checks that a request is within the limits, and that it can be searched without
+// failing: the predicate and generator have to be set, and the generator has to produce
+// selections of the edges sent along.
+func (l Limits) Validate(request Request) error {
+	if request.ID == "" {
+		return invalid("missing request ID")
+	}
+	if request.Predicate == nil {
+		return invalid("missing predicate")
+	}
+	if request.Gen == nil {
+		return invalid("missing generator")
+	}
+	if request.BalFactor < 1 {
+		return invalid("balance factor %d is not positive", request.BalFactor)
+	}
+	if request.Limit < 0 || request.ProgressInterval < 0 {
+		return invalid("negative limit or progress interval")
+	}
+
+	n := request.Edges.Len()
+	if request.Subgraph.Edges.Len() == 0 || n == 0 {
+		return invalid("no edges to search")
+	}
+	for _, count := range []int{n, request.Subgraph.Edges.Len()} {
+		if l.MaxEdges > 0 && count > l.MaxEdges {
+			return invalid("%d edges, at most %d allowed", count, l.MaxEdges)
+		}
+	}
+	if l.MaxVertices > 0 {
+		if count := countVertices(request.Subgraph.Edges, request.Edges); count > l.MaxVertices {
+			return invalid("%d vertices, at most %d allowed", count, l.MaxVertices)
+		}
+	}
+	for _, special := range request.Subgraph.Special {
+		if special.Len() == 0 {
+			return invalid("empty special edge")
+		}
+	}
+
+	return validateGenerator(request.Gen, n)
+}
+
+// invalid returns an error wrapping ErrInvalid
+func invalid(format string, args ...interface{}) error {
+	return fmt.Errorf("%w: %s", ErrInvalid, fmt.Sprintf(format, args...))
+}
+
+// validateGenerator checks that a generator produces selections out of n edges
+func validateGenerator(generator lib.Generator, n int) error {
+	gen, ok := generator.(*lib.CombinationIterator)
+	if !ok || gen == nil {
+		return invalid("unsupported generator %T", generator)
+	}
+	if gen.N != n {
+		return invalid("generator over %d edges, but %d sent", gen.N, n)
+	}
+	if gen.K < 1 || gen.K > n || gen.OldK < gen.K {
+		return invalid("generator picks %d edges out of %d", gen.K, n)
+	}
+	if gen.StepSize < 1 {
+		return invalid("generator step size %d is not positive", gen.StepSize)
+	}
+	if gen.Combination == nil && !gen.Confirmed {
+		return invalid("generator has no combination to confirm")
+	}
+	if gen.Combination != nil {
+		if len(gen.Combination) != gen.K {
+			return invalid("generator combination of %d edges, expected %d", len(gen.Combination), gen.K)
+		}
+		for i, e := range gen.Combination {
+			if e < 0 || e >= n || (i > 0 && e <= gen.Combination[i-1]) {
+				return invalid("generator combination %v is not a selection of %d edges", gen.Combination, n)
+			}
+		}
+	}
+
+	return nil
+}
+
+// countVertices returns the number of distinct vertices of the given edges
+func countVertices(edges ...lib.Edges) int {
+	seen := make(map[int]bool)
+	for _, e := range edges {
+		for _, edge := range e.Slice() {
+			for _, v := range edge.Vertices {
+				seen[v] = true
+			}
+		}
+	}
+
+	return len(seen)
+}
@@ -0,0 +1,345 @@
+package lib
+
+import (
+	"context"
+	"crypto/subtle"
+	"io"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// WebSocketPath is where a WebSocketTransport listening on its own address accepts workers
+const WebSocketPath = "/ws"
+
+const (
+	pingInterval = 20 * time.Second // how often the master checks that a worker is still there
+	pongTimeout  = 3 * pingInterval // after which a silent worker is dropped
+)
+
+// TokenParam is the query parameter carrying the token of a worker joining a WebSocketTransport,
+// for workers which cannot set the Authorization header, such as those running in a web page
+const TokenParam = "token"
+
+// A WebSocketTransport lets workers join the search by connecting to the master over a
+// WebSocket, such as volunteers on idle machines, or workers compiled to WebAssembly. It is an
+// http.Handler, to be mounted on a server of the master, or it listens on Addr by itself.
+//
+// Every binary WebSocket message carries one frame, as exchanged by Worker.ServeStream (see
+// Worker.ServeWebSocket). Requests are spread over the connected workers following the Balancing,
+// and wait while no worker is connected. The requests in flight on a connection which drops are
+// sent to the other workers, up to Retries times each, after which they are answered with an
+// error, so that the master searches them itself.
+//
+// Anyone reaching the address can join, unless a Token is set, which workers have to present as
+// a bearer token or in the TokenParam of the URL. Web pages may only connect from the Origins.
+// As the workers are not trusted, the master checks every separator they send back.
+type WebSocketTransport struct {
+	Addr      string // optional, accept workers on this address at WebSocketPath
+	Balancing Balancing
+	Retries   int      // times a request is sent again after its connection dropped
+	Logger    *Logger  // optional, DefaultLogger is used if not set
+	Token     string   // optional, the secret a worker has to present to join
+	Origins   []string // web pages allowed to connect (e.g. https://example.org), only the host of the master if empty
+
+	once     sync.Once
+	err      error // of listening on Addr
+	pool     *streamPool
+	upgrader websocket.Upgrader
+	server   *http.Server
+	mux      sync.Mutex
+	conns    map[*websocket.Conn]bool
+}
+
+// wsWriter sends every write as a binary message, which is one frame as written by writeFrame
+type wsWriter struct {
+	conn *websocket.Conn
+}
+
+func (w wsWriter) Write(b []byte) (int, error) {
+	w.conn.SetWriteDeadline(time.Now().Add(writeTimeout))
+
+	if err := w.conn.WriteMessage(websocket.BinaryMessage, b); err != nil {
+		w.conn.Close() // a frame which was partly sent leaves the stream unusable
+		return 0, err
+	}
+
+	return len(b), nil
+}
+
+// wsReader reads the binary messages of a connection as one stream
+type wsReader struct {
+	conn    *websocket.Conn
+	current io.Reader // the message being read
+}
+
+func (r *wsReader) Read(b []byte) (int, error) {
+	for {
+		if r.current == nil {
+			kind, reader, err := r.conn.NextReader()
+			if err != nil {
+				return 0, err
+			}
+			if kind != websocket.BinaryMessage {
+				continue
+			}
+			r.current = reader
+		}
+
+		n, err := r.current.Read(b)
+		if err == io.EOF {
+			r.current = nil
+			if n == 0 {
+				continue
+			}
+			err = nil
+		}
+		return n, err
+	}
+}
+
+// init sets up the pool of workers, and starts listening if an address is given
+func (t *WebSocketTransport) init() error {
+	t.once.Do(func() {
+		logger := t.Logger
+		if logger == nil {
+			logger = DefaultLogger
+		}
+		t.pool = newStreamPool(nil, t.Balancing, t.Retries, logger)
+		t.conns = make(map[*websocket.Conn]bool)
+		t.upgrader = websocket.Upgrader{
+			ReadBufferSize:  64 << 10,
+			WriteBufferSize: 64 << 10,
+		}
+		if len(t.Origins) > 0 {
+			t.upgrader.CheckOrigin = t.allowOrigin
+		}
+		if t.Token == "" {
+			logger.Warn("Accepting workers without a token")
+		}
+
+		if t.Addr == "" {
+			return
+		}
+
+		listener, err := net.Listen("tcp", t.Addr)
+		if err != nil {
+			t.err = err
+			return
+		}
+		mux := http.NewServeMux()
+		mux.Handle(WebSocketPath, t)
+		t.server = &http.Server{Handler: mux}
+
+		logger.Info("Waiting for workers", "address", listener.Addr().String(), "path", WebSocketPath)
+		go t.server.Serve(listener)
+	})
+
+	return t.err
+}
+
+// allowOrigin accepts workers which are not web pages, and those on one of the Origins
+func (t *WebSocketTransport) allowOrigin(r *http.Request) bool {
+	origin := r.Header.Get("Origin")
+	if origin == "" {
+		return true
+	}
+	for _, allowed := range t.Origins {
+		if strings.EqualFold(origin, allowed) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// authorized returns true if the worker presents the Token, or none is needed
+func (t *WebSocketTransport) authorized(r *http.Request) bool {
+	if t.Token == "" {
+		return true
+	}
+
+	token := r.URL.Query().Get(TokenParam)
+	if auth := r.Header.Get("Authorization"); strings.HasPrefix(auth, "Bearer ") {
+		token = strings.TrimPrefix(auth, "Bearer ")
+	}
+
+	return subtle.ConstantTimeCompare([]byte(token), []byte(t.Token)) == 1
+}
+
+// untrusted marks the workers as anyone who could connect
+func (t *WebSocketTransport) untrusted() bool {
+	return true
+}
+
+// ServeHTTP accepts a worker, and exchanges messages with it until the connection drops
+func (t *WebSocketTransport) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	t.init()
+	if t.pool.isClosed() {
+		http.Error(w, ErrClosed.Error(), http.StatusServiceUnavailable)
+		return
+	}
+	if !t.authorized(r) {
+		t.pool.logger.Warn("Rejecting worker without a valid token", "worker", r.RemoteAddr)
+		http.Error(w, "invalid token", http.StatusUnauthorized)
+		return
+	}
+
+	conn, err := t.upgrader.Upgrade(w, r, nil)
+	if err != nil {
+		return // the upgrader has replied with the error
+	}
+	conn.SetReadLimit(int64(maxFrame) + 4)
+
+	t.mux.Lock()
+	t.conns[conn] = true
+	t.mux.Unlock()
+
+	logger := t.pool.logger.With("worker", r.RemoteAddr)
+	logger.Info("Worker connected", "workers", t.Connected())
+
+	// the worker answers pings while it is searching, so silence means it is gone
+	conn.SetReadDeadline(time.Now().Add(pongTimeout))
+	conn.SetPongHandler(func(string) error {
+		return conn.SetReadDeadline(time.Now().Add(pongTimeout))
+	})
+	stop := make(chan struct{})
+	go func() {
+		ticker := time.NewTicker(pingInterval)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-ticker.C:
+				if err := conn.WriteControl(websocket.PingMessage, nil, time.Now().Add(writeTimeout)); err != nil {
+					conn.Close()
+					return
+				}
+			case <-stop:
+				return
+			}
+		}
+	}()
+
+	s := t.pool.add(r.RemoteAddr)
+	t.pool.up(s, wsWriter{conn: conn})
+	t.pool.read(s, &wsReader{conn: conn})
+	t.pool.down(s)
+	t.pool.remove(s)
+
+	close(stop)
+	conn.Close()
+
+	t.mux.Lock()
+	delete(t.conns, conn)
+	t.mux.Unlock()
+
+	if !t.pool.isClosed() {
+		logger.Info("Worker disconnected", "workers", t.Connected())
+	}
+}
+
+// Connected returns the number of workers currently connected
+func (t *WebSocketTransport) Connected() int {
+	t.mux.Lock()
+	defer t.mux.Unlock()
+
+	return len(t.conns)
+}
+
+// Send passes a request to one of the connected workers, chosen following the Balancing
+func (t *WebSocketTransport) Send(ctx context.Context, msg Message) error {
+	if err := t.init(); err != nil {
+		return err
+	}
+
+	return t.pool.send(msg)
+}
+
+// Receive passes on the messages of all workers. As the workers only ever reply to this master,
+// messages which handle does not accept are dropped.
+func (t *WebSocketTransport) Receive(ctx context.Context, handle func(msg Message) bool) error {
+	if err := t.init(); err != nil {
+		return err
+	}
+
+	return t.pool.receive(ctx, handle)
+}
+
+// Close stops accepting workers and drops all connections, the transport cannot be used afterwards
+func (t *WebSocketTransport) Close() error {
+	t.init()
+	if !t.pool.close() {
+		return nil
+	}
+
+	if t.server != nil {
+		t.server.Close()
+	}
+
+	t.mux.Lock()
+	defer t.mux.Unlock()
+
+	for conn := range t.conns {
+		conn.Close()
+	}
+
+	return nil
+}
+
+// ServeWebSocket connects to a master accepting workers over a WebSocket at the given URL, and
+// serves it with ServeStream, connecting again whenever the connection drops, until ctx is done.
+// The Token of the worker is presented as a bearer token.
+func (w *Worker) ServeWebSocket(ctx context.Context, url string) error {
+	delay := restartDelay
+
+	for {
+		var header http.Header
+		if w.Token != "" {
+			header = http.Header{"Authorization": []string{"Bearer " + w.Token}}
+		}
+
+		conn, _, err := websocket.DefaultDialer.DialContext(ctx, url, header)
+		if err != nil {
+			if ctx.Err() != nil {
+				return nil
+			}
+			w.Logger.Warn("Failed to connect to master", "error", err, "retry", delay)
+
+			select {
+			case <-ctx.Done():
+				return nil
+			case <-time.After(delay):
+			}
+			if delay *= 2; delay > maxReconnectDelay {
+				delay = maxReconnectDelay
+			}
+			continue
+		}
+		delay = restartDelay
+		conn.SetReadLimit(int64(maxFrame) + 4)
+		w.Logger.Info("Connected to master", "url", url)
+
+		stop := make(chan struct{})
+		go func() {
+			select {
+			case <-ctx.Done():
+				conn.Close()
+			case <-stop:
+			}
+		}()
+
+		err = w.ServeStream(ctx, &wsReader{conn: conn}, wsWriter{conn: conn})
+		close(stop)
+		conn.Close()
+
+		if ctx.Err() != nil {
+			return nil
+		}
+		w.Logger.Warn("Connection to master lost, reconnecting", "error", err)
+	}
+}
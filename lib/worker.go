@@ -0,0 +1,384 @@
+package lib
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/gob"
+	"encoding/hex"
+	"fmt"
+	"runtime/debug"
+	"sync"
+	"time"
+
+	"cloud.google.com/go/pubsub"
+	"github.com/cem-okulmus/BalancedGo/lib"
+	"go.opentelemetry.io/otel/attribute"
+)
+
+// WorkerID identifies this worker instance in the solutions it sends back
+var WorkerID = newID()
+
+// newID produces a random identifier
+func newID() string {
+	b := make([]byte, 8)
+	if _, err := rand.Read(b); err != nil {
+		return "unknown"
+	}
+	return hex.EncodeToString(b)
+}
+
+func init() {
+	// register the concrete types that can appear inside a Request, so that both the master
+	// and the workers are able to (de)serialise them
+	gob.Register(lib.BalancedCheck{})
+	gob.Register(lib.ParentCheck{})
+	gob.Register(&lib.CombinationIterator{})
+}
+
+// EncodeSolution serialises a Solution, to be sent back to the master
+func EncodeSolution(sol Solution) ([]byte, error) {
+	var Encodebuffer bytes.Buffer
+	enc := gob.NewEncoder(&Encodebuffer)
+
+	err := enc.Encode(sol)
+
+	return Encodebuffer.Bytes(), err
+}
+
+// Work runs the generator of the request until either a separator satisfying the predicate is
+// found, or the generator is exhausted. The returned Solution also carries the statistics of
+// this execution. If the search panics, the panic is recovered and returned as an error, together
+// with a Solution containing the state of the generator at that point.
+// If the request asks for progress reports, and progress is not nil, it is called periodically.
+func Work(request Request, progress func(Progress)) (sol Solution, err error) {
+	gen := request.Gen
+	start := time.Now()
+	startCPU := cpuTime()
+
+	// let it run to completion, and then send back the Solution struct
+	var solution []int
+	var candidates, checks int
+
+	defer func() {
+		if r := recover(); r != nil {
+			err = fmt.Errorf("recovered from panic: %v\n%s", r, debug.Stack())
+			sol = Solution{ID: request.ID, Gen: gen}
+		}
+		sol.Candidates = candidates
+		sol.Checks = checks
+		sol.WallTime = time.Since(start)
+		sol.CPUTime = cpuTime() - startCPU
+		sol.WorkerID = WorkerID
+	}()
+
+	var sep lib.Edges
+
+	var limitReached bool
+	lastReport := start
+
+	for gen.HasNext() && len(solution) == 0 {
+		if request.Limit > 0 && candidates >= request.Limit {
+			limitReached = true // the current candidate is left unconfirmed for the next chunk
+			break
+		}
+
+		j := gen.GetNext()
+		candidates++
+
+		sep = lib.GetSubset(request.Edges, j) // check new possible sep
+
+		if gen.CheckFound() { // check already performed by a previous run
+			solution = make([]int, len(j))
+			copy(solution, j)
+		} else {
+			checks++
+			if request.Predicate.Check(&request.Subgraph, &sep, request.BalFactor) {
+				gen.Found() // cache result
+
+				solution = make([]int, len(j))
+				copy(solution, j)
+			}
+		}
+		gen.Confirm()
+
+		if progress != nil && request.ProgressInterval > 0 && len(solution) == 0 &&
+			time.Since(lastReport) >= request.ProgressInterval {
+			lastReport = time.Now()
+			progress(Progress{
+				ID:         request.ID,
+				WorkerID:   WorkerID,
+				Gen:        gen,
+				Candidates: candidates,
+				Elapsed:    time.Since(start),
+			})
+		}
+	}
+
+	sol = Solution{
+		Valid:        len(solution) > 0,
+		Selection:    solution,
+		Gen:          gen,
+		ID:           request.ID,
+		LimitReached: limitReached,
+	}
+
+	return sol, nil
+}
+
+// A Worker handles the requests sent out by the master
+type Worker struct {
+	Logger *Logger
+	Limits Limits // requests beyond these are rejected
+	Token  string // optional, presented to a master accepting workers over a WebSocket
+
+	mux       sync.Mutex
+	completed *recentCache    // replies to recently completed requests, by request ID
+	sessions  *sessionCache   // graphs of the searches the master opened a session for
+	inflight  map[string]bool // requests currently being handled
+}
+
+// completedCacheSize is the number of replies a Worker keeps to answer redeliveries
+const completedCacheSize = 256
+
+// NewWorker produces a Worker logging to the given Logger, with the worker ID attached
+func NewWorker(logger *Logger) *Worker {
+	return &Worker{
+		Logger:    logger.With("worker", WorkerID),
+		Limits:    DefaultLimits,
+		sessions:  newSessionCache(),
+		completed: newRecentCache(completedCacheSize),
+		inflight:  make(map[string]bool),
+	}
+}
+
+// begin marks a request as being handled, returning false if it already is
+func (w *Worker) begin(id string) bool {
+	w.mux.Lock()
+	defer w.mux.Unlock()
+
+	if w.inflight[id] {
+		return false
+	}
+	w.inflight[id] = true
+
+	return true
+}
+
+// end marks a request as no longer being handled
+func (w *Worker) end(id string) {
+	w.mux.Lock()
+	defer w.mux.Unlock()
+
+	delete(w.inflight, id)
+}
+
+// cached returns the reply sent for a recently completed request, if any
+func (w *Worker) cached(id string) (*reply, bool) {
+	if id == "" {
+		return nil, false
+	}
+
+	return w.completed.get(id)
+}
+
+// Handle decodes a request, runs the search and returns the encoded Solution, together
+// with the attributes to send along with it. This is the part of the worker which is independent
+// of how messages are delivered. If emit is not nil, it is used to send progress messages to the
+// master while searching, it must not hold on to the passed data.
+// Pub/Sub delivers at least once, so a request may arrive more than once: for a request completed
+// recently, the same reply is returned again, and for one still being worked on, ErrDuplicate.
+// A request which is invalid or exceeds the Limits, or whose search panicked, is answered with a
+// Solution carrying the error.
+// A request of a session which is not held here is answered with SessionLost, and a message
+// closing a session is not answered, with ErrNoReply.
+func (w *Worker) Handle(ctx context.Context, data []byte, attrs map[string]string,
+	emit func(data []byte, attrs map[string]string)) ([]byte, map[string]string, error) {
+	workerRequests.Inc()
+	payloadBytes.WithLabelValues("request").Observe(float64(len(data)))
+
+	if r, ok := w.cached(attrs[attrRequest]); ok {
+		duplicates.WithLabelValues("worker").Inc()
+		w.Logger.Info("Resending reply to duplicate request", "request", attrs[attrRequest])
+		return r.data, r.attrs, nil
+	}
+
+	if err := verify(attrs, data); err != nil {
+		workerErrors.WithLabelValues("corrupt").Inc()
+		return nil, nil, err
+	}
+
+	ctx = extractTrace(ctx, attrs, "queue")
+	ctx, span := Tracer().Start(ctx, "worker compute")
+	defer span.End()
+
+	request, err := w.Limits.decode(data)
+	if err == nil && request.Close {
+		w.sessions.close(request.Session)
+		w.Logger.Debug("Closed session", "session", request.Session)
+		return nil, nil, ErrNoReply
+	}
+
+	cached, held := w.sessions.attach(&request)
+	if err == nil && !held {
+		w.Logger.Info("Session not held, asking for the graph", "session", request.Session, "request", request.ID)
+		return signedSolution(Solution{ID: request.ID, SessionLost: true, WorkerID: WorkerID}, request.RunID)
+	}
+
+	if err == nil {
+		err = w.Limits.Validate(request)
+	}
+	if err != nil {
+		workerErrors.WithLabelValues("invalid").Inc()
+		return w.reject(attrs, request, err)
+	}
+	if request.Session != "" && !cached {
+		w.sessions.open(request.Session, request.Subgraph, request.Edges)
+	}
+	span.SetAttributes(graphAttributes(&request.Subgraph, request.Edges.Len())...)
+
+	logger := w.Logger.With("run", request.RunID, "request", request.ID, "subgraph", request.Subgraph.Edges.Len())
+	logger.Debug("Received request", "bytes", len(data), "edges", request.Edges.Len())
+
+	if r, ok := w.cached(request.ID); ok {
+		duplicates.WithLabelValues("worker").Inc()
+		logger.Info("Resending reply to duplicate request")
+		return r.data, r.attrs, nil
+	}
+	if !w.begin(request.ID) {
+		duplicates.WithLabelValues("worker").Inc()
+		return nil, nil, ErrDuplicate
+	}
+	defer w.end(request.ID)
+
+	var progress func(Progress)
+	if emit != nil {
+		progress = func(p Progress) {
+			out, err := EncodeProgress(p) // encoding takes a snapshot of the generator
+			if err != nil {
+				workerErrors.WithLabelValues("encode").Inc()
+				logger.Error("Encoding error", "error", err)
+				return
+			}
+			logger.Debug("Sending progress", "candidates", p.Candidates, "elapsed", p.Elapsed)
+			progAttrs := ProgressAttributes(injectTrace(ctx))
+			progAttrs[attrRequest] = request.ID
+			progAttrs[attrRun] = request.RunID
+			emit(out, sign(progAttrs, out))
+		}
+	}
+
+	sol, err := Work(request, progress)
+	if err != nil {
+		workerErrors.WithLabelValues("panic").Inc()
+		var last []int
+		if sol.Gen != nil {
+			last = sol.Gen.GetNext()
+		}
+		logger.Error("Search failed", "error", err, "last_selection", last)
+		return w.reject(attrs, request, err) // the master would otherwise wait for the reply
+	}
+	sol.GraphCached = cached
+	candidatesChecked.Observe(float64(sol.Checks))
+	span.SetAttributes(attribute.Int("candidates", sol.Candidates), attribute.Bool("valid", sol.Valid))
+
+	out, err := EncodeSolution(sol)
+	if err != nil {
+		workerErrors.WithLabelValues("encode").Inc()
+		return nil, nil, fmt.Errorf("encoding error: %v", err)
+	}
+	payloadBytes.WithLabelValues("solution").Observe(float64(len(out)))
+
+	logger.Info("Sending solution", "valid", sol.Valid, "candidates", sol.Candidates,
+		"wall_time", sol.WallTime, "bytes", len(out))
+
+	outAttrs := injectTrace(ctx)
+	outAttrs[attrRequest] = request.ID // lets the master route the reply without decoding it
+	outAttrs[attrRun] = request.RunID  // lets the master subscribe to the replies of its run only
+	sign(outAttrs, out)
+	w.completed.add(request.ID, &reply{data: out, attrs: outAttrs})
+
+	return out, outAttrs, nil
+}
+
+// reject answers a request that failed validation or whose search failed, so that the master
+// does not wait for it. The request ID is taken from the attributes if the data could not be
+// decoded.
+func (w *Worker) reject(attrs map[string]string, request Request, reason error) ([]byte, map[string]string, error) {
+	id, runID := attrs[attrRequest], attrs[attrRun]
+	if id == "" {
+		id, runID = request.ID, request.RunID
+	}
+	if id == "" {
+		return nil, nil, reason // there is no way to tell the master which request failed
+	}
+
+	w.Logger.Warn("Rejecting request", "request", id, "run", runID, "error", reason)
+
+	out, outAttrs, err := failure(id, runID, reason)
+	if err != nil {
+		workerErrors.WithLabelValues("encode").Inc()
+		return nil, nil, err
+	}
+	w.completed.add(id, &reply{data: out, attrs: outAttrs})
+
+	return out, outAttrs, nil
+}
+
+// failure encodes a Solution telling the master that a request could not be searched
+func failure(id string, runID string, reason error) ([]byte, map[string]string, error) {
+	return signedSolution(Solution{ID: id, Error: reason.Error(), WorkerID: WorkerID}, runID)
+}
+
+// signedSolution encodes a Solution which did not involve any search, with its attributes
+func signedSolution(sol Solution, runID string) ([]byte, map[string]string, error) {
+	out, err := EncodeSolution(sol)
+	if err != nil {
+		return nil, nil, fmt.Errorf("encoding error: %v", err)
+	}
+
+	attrs := map[string]string{attrRequest: sol.ID, attrRun: runID}
+
+	return out, sign(attrs, out), nil
+}
+
+// Serve pulls requests from a subscription and publishes the replies to the answer topic, until
+// ctx is done or receiving fails. This is the loop of a long-running worker process.
+func (w *Worker) Serve(ctx context.Context, sub *pubsub.Subscription, answers *pubsub.Topic) error {
+	return sub.Receive(ctx, func(ctx context.Context, msg *pubsub.Message) {
+		if msg.DeliveryAttempt != nil && *msg.DeliveryAttempt > 1 {
+			CountRedelivery()
+		}
+
+		// progress reports are sent without waiting for them to be published
+		emit := func(data []byte, attrs map[string]string) {
+			answers.Publish(ctx, &pubsub.Message{
+				Data:       data,
+				Attributes: attrs,
+			})
+		}
+
+		data, attrs, err := w.Handle(ctx, msg.Data, msg.Attributes, emit)
+		if err == ErrDuplicate || err == ErrNoReply {
+			msg.Ack() // the other delivery will reply, if any reply is needed
+			return
+		}
+		if err != nil {
+			w.Logger.Error("Failed to handle request", "error", err, "message", msg.ID)
+			msg.Ack() // no point in retrying a message that cannot be decoded
+			return
+		}
+
+		res := answers.Publish(ctx, &pubsub.Message{
+			Data:       data,
+			Attributes: attrs,
+		})
+		if _, err = res.Get(ctx); err != nil {
+			w.Logger.Error("Publish failed", "error", err, "message", msg.ID)
+			msg.Nack()
+			return
+		}
+
+		msg.Ack()
+	})
+}
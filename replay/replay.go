@@ -0,0 +1,131 @@
+package main
+
+// Runs captured requests through the worker logic locally, to debug the worker without deploying
+// it. Requests are captured by the master with the -capture flag, or dumped in shadow mode.
+// Requests are validated as a worker would, so some captured by versions which did not validate
+// them are rejected. These can still be run with -unchecked.
+
+import (
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"time"
+
+	"github.com/cem-okulmus/BalancedGo/lib"
+	cloudlib "github.com/cem-okulmus/GHDDistributedSearch/lib"
+)
+
+func main() {
+	progress := flag.Duration("progress", 0, "print the progress of the search at this interval, 0 to disable")
+	limit := flag.Int("limit", -1, "override the number of candidates to check, 0 for no limit, -1 to keep that of the request")
+	unchecked := flag.Bool("unchecked", false, "run requests which are not valid, or exceed the limits of a worker (the search may fail)")
+	flag.Usage = func() {
+		fmt.Fprintln(os.Stderr, "Usage: replay [flags] <request file>...")
+		flag.PrintDefaults()
+	}
+	flag.Parse()
+
+	if flag.NArg() == 0 {
+		flag.Usage()
+		os.Exit(2)
+	}
+
+	failed := false
+	for _, file := range flag.Args() {
+		if !replay(file, *progress, *limit, *unchecked) {
+			failed = true
+		}
+		fmt.Println()
+	}
+
+	if failed {
+		os.Exit(1)
+	}
+}
+
+// replay runs a single captured request, returning false if it could not be run or panicked
+func replay(file string, interval time.Duration, limit int, unchecked bool) bool {
+	fmt.Println("Request file: ", file)
+
+	data, err := ioutil.ReadFile(file)
+	if err != nil {
+		fmt.Println("Read error: ", err)
+		return false
+	}
+
+	decode := cloudlib.DecodeRequest
+	if unchecked {
+		decode = cloudlib.DecodeUnchecked
+	}
+	request, err := decode(data)
+	if err != nil {
+		fmt.Println("Decode error: ", err)
+		if _, uncheckedErr := cloudlib.DecodeUnchecked(data); uncheckedErr == nil {
+			fmt.Println("The request can be run with -unchecked")
+		}
+		return false
+	}
+
+	fmt.Println("ID: ", request.ID)
+	fmt.Println("Run: ", request.RunID)
+	// the names of the edges are not sent along, so only their numbers can be shown
+	fmt.Println("Subgraph edges: ", request.Subgraph.Edges.Len())
+	fmt.Println("Edges to choose from: ", request.Edges.Len())
+	fmt.Printf("Predicate: %T\n", request.Predicate)
+	fmt.Println("Generator: ", request.Gen)
+	fmt.Println("Balance factor: ", request.BalFactor)
+
+	if limit >= 0 {
+		request.Limit = limit
+	}
+	fmt.Println("Limit: ", request.Limit)
+
+	var report func(cloudlib.Progress)
+	if interval > 0 {
+		request.ProgressInterval = interval
+		report = func(p cloudlib.Progress) {
+			fmt.Printf("  progress: %d candidates after %v\n", p.Candidates, p.Elapsed)
+		}
+	}
+
+	sol, err := cloudlib.Work(request, report)
+	if err != nil {
+		fmt.Println("\nSearch failed: ", err) // includes the stack of a panic
+		return false
+	}
+
+	fmt.Println("\nValid: ", sol.Valid)
+	if sol.Valid {
+		var names []int
+		for _, e := range lib.GetSubset(request.Edges, sol.Selection).Slice() {
+			names = append(names, e.Name)
+		}
+		fmt.Println("Separator: ", names)
+	}
+	fmt.Println("Limit reached: ", sol.LimitReached)
+	fmt.Println("Candidates: ", sol.Candidates)
+	fmt.Println("Checks: ", sol.Checks)
+	fmt.Println("Wall time: ", sol.WallTime)
+	fmt.Println("CPU time: ", sol.CPUTime)
+
+	// compare with the solution sent by the worker, if it was captured as well
+	dir, name := filepath.Split(file)
+	_, solFile := cloudlib.CaptureFiles(dir, strings.TrimSuffix(name, filepath.Ext(name)))
+	if captured, err := ioutil.ReadFile(solFile); err == nil {
+		old, err := cloudlib.DecodeSolution(captured)
+		switch {
+		case err != nil:
+			fmt.Println("Captured solution unreadable: ", err)
+		case old.Valid == sol.Valid && reflect.DeepEqual(old.Selection, sol.Selection):
+			fmt.Println("Matches the captured solution")
+		default:
+			fmt.Println("Differs from the captured solution, valid: ", old.Valid, ", selection: ", old.Selection)
+		}
+	}
+
+	return true
+}
@@ -0,0 +1,46 @@
+package test
+
+import (
+	"testing"
+	"time"
+
+	"github.com/cem-okulmus/BalancedGo/lib"
+	cloudlib "github.com/cem-okulmus/GHDDistributedSearch/lib"
+)
+
+func TestChaosDecomp(t *testing.T) {
+	if testing.Short() {
+		t.Skip("skipping integration test in short mode")
+	}
+
+	h := newHarness(t)
+
+	chaos := &cloudlib.ChaosTransport{
+		Transport: h.Dispatcher.Transport,
+		Faults: cloudlib.Faults{
+			Drop:      0.1,
+			Duplicate: 0.1,
+			Delay:     0.1,
+			Reorder:   0.1,
+			Corrupt:   0.1,
+			MaxDelay:  50 * time.Millisecond,
+			Seed:      1,
+		},
+	}
+	h.Dispatcher.Transport = chaos
+
+	// lost requests and solutions are only noticed by the missing heartbeats
+	compareWithLocal(t, func(stats *cloudlib.RunStats) lib.SearchGenerator {
+		gen := h.generator(stats)
+		gen.Heartbeats = &cloudlib.Heartbeats{Interval: 20 * time.Millisecond, Timeout: 200 * time.Millisecond}
+		return gen
+	})
+
+	injected := chaos.Injected()
+	for _, kind := range []string{"drop", "duplicate", "delay", "reorder", "corrupt"} {
+		if injected[kind] == 0 {
+			t.Errorf("No %s fault injected, the test does not cover it", kind)
+		}
+	}
+	t.Log("Injected faults: ", injected)
+}
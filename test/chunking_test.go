@@ -0,0 +1,107 @@
+package test
+
+import (
+	"io/ioutil"
+	"log"
+	"math"
+	"os"
+	"testing"
+	"time"
+
+	algo "github.com/cem-okulmus/BalancedGo/algorithms"
+	"github.com/cem-okulmus/BalancedGo/lib"
+	cloudlib "github.com/cem-okulmus/GHDDistributedSearch/lib"
+)
+
+func TestChunkSizer(t *testing.T) {
+	chunks := cloudlib.NewChunkSizer(time.Second, 10)
+	if size := chunks.Next(10); size != 10 {
+		t.Errorf("expected the initial size 10 before any observation, got %d", size)
+	}
+
+	// solutions without checks or time say nothing about the throughput
+	chunks.Observe(cloudlib.Solution{WorkerID: "a", WallTime: time.Second}, 10)
+	chunks.Observe(cloudlib.Solution{WorkerID: "a", Checks: 100}, 10)
+	if size := chunks.Next(10); size != 10 {
+		t.Errorf("empty observations changed the size to %d", size)
+	}
+
+	// 100 checks on 10 edges in a second, so 100 checks on 10 edges fill the target
+	chunks.Observe(cloudlib.Solution{WorkerID: "a", Checks: 100, WallTime: time.Second}, 10)
+	if size := chunks.Next(10); size != 100 {
+		t.Errorf("expected 100 candidates, got %d", size)
+	}
+	if size := chunks.Next(20); size != 50 {
+		t.Errorf("expected 50 candidates on a subgraph twice as large, got %d", size)
+	}
+
+	// the rates of the workers are averaged, and each is smoothed over its observations
+	chunks.Observe(cloudlib.Solution{WorkerID: "b", Checks: 300, WallTime: time.Second}, 10)
+	chunks.Observe(cloudlib.Solution{WorkerID: "a", Checks: 200, WallTime: time.Second}, 10)
+	summary := chunks.Summary()
+	if len(summary.Rates) != 2 || summary.Rates["b"] != 3000 || math.Abs(summary.Rates["a"]-1300) > 1e-6 {
+		t.Errorf("wrong rates: %v", summary.Rates)
+	}
+	if math.Abs(summary.Rate-2150) > 1e-6 {
+		t.Errorf("expected the average rate 2150, got %v", summary.Rate)
+	}
+	if size := chunks.Next(10); size != 215 || chunks.Summary().LastChunk != 215 {
+		t.Errorf("expected 215 candidates, got %d", size)
+	}
+
+	chunks.Max = 100
+	if size := chunks.Next(10); size != 100 {
+		t.Errorf("size %d above the maximum", size)
+	}
+	chunks.Min = 1000
+	chunks.Max = 0
+	if size := chunks.Next(10); size != 1000 {
+		t.Errorf("size %d below the minimum", size)
+	}
+
+	// the summary is a copy
+	summary.Rates["a"] = 0
+	if chunks.Summary().Rates["a"] == 0 {
+		t.Error("changing the summary changed the rates")
+	}
+}
+
+func TestChunkedSearchLearnsRates(t *testing.T) {
+	log.SetOutput(ioutil.Discard)
+	defer log.SetOutput(os.Stderr)
+
+	dispatcher := &cloudlib.Dispatcher{
+		Transport: &cloudlib.SimTransport{Model: cloudlib.DefaultLatencyModel, Worker: cloudlib.NewWorker(quiet)},
+		Logger:    quiet,
+	}
+	defer dispatcher.Close()
+
+	dat, err := ioutil.ReadFile("testdata/grid3.hg")
+	if err != nil {
+		t.Fatal(err)
+	}
+	graph, _ := lib.GetGraph(string(dat))
+
+	chunks := cloudlib.NewChunkSizer(time.Millisecond, 5)
+	chunks.Max = 20
+	stats := &cloudlib.RunStats{}
+	solver := algo.LogKDecomp{Graph: graph, K: 2, BalFactor: 2}
+	solver.SetGenerator(cloudlib.DistSearchGen{Chunks: chunks, Stats: stats, Logger: quiet, Dispatcher: dispatcher})
+	if !solver.FindDecomp().Correct(graph) {
+		t.Fatal("no correct decomposition found")
+	}
+
+	// the worker runs in this process, so it reports the same instance ID
+	summary := chunks.Summary()
+	if summary.Rates[cloudlib.WorkerID] <= 0 || len(summary.Rates) != 1 {
+		t.Errorf("throughput of the worker %s not learned: %v", cloudlib.WorkerID, summary.Rates)
+	}
+	if summary.LastChunk < 1 || summary.LastChunk > 20 {
+		t.Errorf("last chunk of %d candidates outside of the bounds", summary.LastChunk)
+	}
+
+	// a chunk never checks more candidates than its limit
+	if s := stats.Summary(); s.Candidates > s.Solutions*20 {
+		t.Errorf("%d candidates checked in %d chunks of at most 20", s.Candidates, s.Solutions)
+	}
+}
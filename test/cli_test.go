@@ -0,0 +1,95 @@
+package test
+
+import (
+	"context"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// buildCLI compiles the cli into a temporary directory, skipping the test without a Go toolchain
+func buildCLI(t *testing.T) string {
+	return buildCommand(t, "../cli", "ghd")
+}
+
+// buildCommand compiles the command in a directory of the repository into a temporary directory,
+// skipping the test without a Go toolchain
+func buildCommand(t *testing.T, dir string, name string) string {
+	goTool, err := exec.LookPath("go")
+	if err != nil {
+		t.Skip("go toolchain not found: ", err)
+	}
+
+	bin := filepath.Join(t.TempDir(), name)
+	if out, err := exec.Command(goTool, "build", "-o", bin, dir).CombinedOutput(); err != nil {
+		t.Fatalf("building %s: %v\n%s", dir, err, out)
+	}
+
+	return bin
+}
+
+// runCLI runs the cli, or another built command, with the given arguments, returning its output
+// and exit code
+func runCLI(t *testing.T, bin string, args ...string) (string, int) {
+	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Minute)
+	defer cancel()
+
+	out, err := exec.CommandContext(ctx, bin, args...).CombinedOutput()
+	if ctx.Err() != nil {
+		t.Fatalf("%v timed out:\n%s", args, out)
+	}
+	if exit, ok := err.(*exec.ExitError); ok {
+		return string(out), exit.ExitCode()
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return string(out), 0
+}
+
+// the flag parsing and the choice of the transport are only covered by running the cli itself
+func TestCLISimulate(t *testing.T) {
+	if testing.Short() {
+		t.Skip("skipping cli test in short mode")
+	}
+	bin := buildCLI(t)
+
+	for _, c := range []struct {
+		args    []string
+		exit    int
+		results []string
+	}{
+		{
+			args:    []string{"-graph", "testdata/grid3.hg", "-width", "2", "-logk", "-simulate"},
+			results: []string{"Correct:  true", "Projected wall-clock time", "Worker wall time", "Distinct workers:  1"},
+		},
+		{
+			// concurrent searches share the virtual clock
+			args:    []string{"-graph", "testdata/large/grid4.hg", "-width", "3", "-logk", "-simulate", "-cpu", "4"},
+			results: []string{"Correct:  true", "Projected wall-clock time"},
+		},
+		{
+			args:    []string{"-graph", "testdata/grid3.hg", "-width", "2", "-logk", "-simulate", "-maxInvocations", "1"},
+			exit:    3,
+			results: []string{"Budget exceeded, searches aborted", "Aborted: the budget was exceeded"},
+		},
+		{
+			args:    []string{"-graph", "testdata/grid3.hg", "-width", "2", "-logk", "-simulate", "-maxInvocations", "1", "-budgetFallback"},
+			results: []string{"Correct:  true", "Budget exceeded, searches run locally"},
+		},
+	} {
+		out, exit := runCLI(t, bin, append(c.args, "-loglevel", "off")...)
+		if exit != c.exit {
+			t.Errorf("%v exited with %d, expected %d:\n%s", c.args, exit, c.exit, out)
+			continue
+		}
+		for _, result := range c.results {
+			if !strings.Contains(out, result) {
+				t.Errorf("%v did not print %q:\n%s", c.args, result, out)
+			}
+		}
+	}
+}
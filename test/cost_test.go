@@ -0,0 +1,42 @@
+package test
+
+import (
+	"io/ioutil"
+	"testing"
+
+	"github.com/cem-okulmus/BalancedGo/lib"
+	cloudlib "github.com/cem-okulmus/GHDDistributedSearch/lib"
+)
+
+func TestBudgetCheckedBeforeFanOut(t *testing.T) {
+	quiet := cloudlib.NewLogger(ioutil.Discard, cloudlib.LevelOff)
+	sim := &cloudlib.SimTransport{Model: cloudlib.DefaultLatencyModel, Worker: cloudlib.NewWorker(quiet)}
+	dispatcher := &cloudlib.Dispatcher{Transport: sim, Logger: quiet}
+	defer dispatcher.Close()
+
+	graph, _ := getRandomGraph(8)
+	gens := lib.SplitCombin(graph.Edges.Len(), 2, 4, false)
+
+	// the four requests of the fan-out do not fit into the budget
+	costs := cloudlib.NewCostTracker(cloudlib.DefaultPrices, cloudlib.Budget{MaxInvocations: 3})
+	search := cloudlib.DistSearchGen{Logger: quiet, Dispatcher: dispatcher, Costs: costs}.
+		GetSearch(&graph, &graph.Edges, 2, gens).(*cloudlib.DistributedSearch)
+	search.FindNext(lib.BalancedCheck{})
+
+	if !search.Aborted || !search.SearchEnded() {
+		t.Error("search over budget was not aborted")
+	}
+	if summary := costs.Summary(); summary.Invocations != 0 || summary.Aborted != 1 {
+		t.Errorf("requests were sent beyond the budget: %+v", summary)
+	}
+
+	// with the fallback, the search is completed locally instead
+	costs = cloudlib.NewCostTracker(cloudlib.DefaultPrices, cloudlib.Budget{MaxInvocations: 3, Fallback: true})
+	search = cloudlib.DistSearchGen{Logger: quiet, Dispatcher: dispatcher, Costs: costs}.
+		GetSearch(&graph, &graph.Edges, 2, gens).(*cloudlib.DistributedSearch)
+	search.FindNext(lib.BalancedCheck{})
+
+	if search.Aborted || costs.Summary().LocalFallbacks != 1 {
+		t.Errorf("search over budget was not run locally: %+v", costs.Summary())
+	}
+}
@@ -95,7 +95,7 @@ func TestDecoding(t *testing.T) {
 
 	sol := cloudlib.Solution{
 		Valid:     false,
-		ID:        0,
+		ID:        "",
 		Selection: []int{},
 	}
 
@@ -0,0 +1,260 @@
+package test
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io/ioutil"
+	"net"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/cem-okulmus/BalancedGo/lib"
+	cloudlib "github.com/cem-okulmus/GHDDistributedSearch/lib"
+)
+
+// flakyReceive fails the first time answers are received
+type flakyReceive struct {
+	cloudlib.Transport
+	failed int32
+}
+
+func (f *flakyReceive) Receive(ctx context.Context, handle func(msg cloudlib.Message) bool) error {
+	if atomic.CompareAndSwapInt32(&f.failed, 0, 1) {
+		return errors.New("transient failure")
+	}
+
+	return f.Transport.Receive(ctx, handle)
+}
+
+func TestDispatcherRestartsReceiving(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	serveTCP(t, listener)
+
+	quiet := cloudlib.NewLogger(ioutil.Discard, cloudlib.LevelOff)
+	transport := &flakyReceive{Transport: &cloudlib.TCPTransport{Addrs: []string{listener.Addr().String()}, Logger: quiet}}
+	dispatcher := &cloudlib.Dispatcher{Transport: transport, Logger: quiet}
+	defer dispatcher.Close()
+
+	graph, _ := getRandomGraph(8)
+	search := cloudlib.DistSearchGen{Logger: quiet, Dispatcher: dispatcher}.
+		GetSearch(&graph, &graph.Edges, 2, lib.SplitCombin(graph.Edges.Len(), 2, 1, false))
+
+	// the search is already waiting when receiving fails, no other search comes along
+	done := make(chan struct{})
+	go func() {
+		search.FindNext(lib.BalancedCheck{})
+		close(done)
+	}()
+
+	select {
+	case <-done:
+	case <-time.After(10 * time.Second):
+		t.Fatal("search still waiting after receiving failed once")
+	}
+	if atomic.LoadInt32(&transport.failed) == 0 {
+		t.Error("receiving did not fail, the test does not cover the restart")
+	}
+}
+
+// scriptedTransport answers each request with the messages returned by reply, without any worker
+type scriptedTransport struct {
+	reply    func(req cloudlib.Request) []cloudlib.Message
+	messages chan cloudlib.Message
+}
+
+func (s *scriptedTransport) Send(ctx context.Context, msg cloudlib.Message) error {
+	req, err := cloudlib.DecodeRequest(msg.Data)
+	if err != nil {
+		return err
+	}
+	for _, reply := range s.reply(req) {
+		s.messages <- reply
+	}
+
+	return nil
+}
+
+func (s *scriptedTransport) Receive(ctx context.Context, handle func(msg cloudlib.Message) bool) error {
+	for {
+		select {
+		case <-ctx.Done():
+			return nil
+		case msg := <-s.messages:
+			handle(msg)
+		}
+	}
+}
+
+func (s *scriptedTransport) Close() error {
+	return nil
+}
+
+// scripted encodes a solution or progress as the message a worker would send
+func scripted(t *testing.T, id string, v interface{}) cloudlib.Message {
+	attrs := map[string]string{"request": id}
+
+	var data []byte
+	var err error
+	switch v := v.(type) {
+	case cloudlib.Solution:
+		data, err = cloudlib.EncodeSolution(v)
+	case cloudlib.Progress:
+		data, err = cloudlib.EncodeProgress(v)
+		attrs = cloudlib.ProgressAttributes(attrs)
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return cloudlib.Message{Data: data, Attributes: attrs}
+}
+
+func TestDispatcherNotBlockedByBusySearch(t *testing.T) {
+	// the first request of the busy search is rejected, so the master searches it itself, while
+	// the other one reports its progress far more often than the search takes its messages
+	var busyRequests int32
+	transport := &scriptedTransport{messages: make(chan cloudlib.Message, 1024)}
+	transport.reply = func(req cloudlib.Request) []cloudlib.Message {
+		switch {
+		case req.RunID == "busy" && atomic.AddInt32(&busyRequests, 1) == 1:
+			return []cloudlib.Message{scripted(t, req.ID, cloudlib.Solution{ID: req.ID, Error: "rejected"})}
+		case req.RunID == "busy":
+			var out []cloudlib.Message
+			for i := 0; i < 200; i++ {
+				out = append(out, scripted(t, req.ID, cloudlib.Progress{ID: req.ID, Gen: req.Gen, Candidates: i}))
+			}
+			return append(out, scripted(t, req.ID, cloudlib.Solution{ID: req.ID, Gen: req.Gen}))
+		}
+		return []cloudlib.Message{scripted(t, req.ID, cloudlib.Solution{ID: req.ID, Gen: req.Gen})}
+	}
+	dispatcher := &cloudlib.Dispatcher{Transport: transport, Logger: quiet}
+	defer dispatcher.Close()
+
+	dat, err := ioutil.ReadFile("testdata/cycle6.hg")
+	if err != nil {
+		t.Fatal(err)
+	}
+	graph, _ := lib.GetGraph(string(dat))
+
+	busy := cloudlib.DistSearchGen{RunID: "busy", Logger: quiet, Dispatcher: dispatcher}.
+		GetSearch(&graph, &graph.Edges, 2, lib.SplitCombin(graph.Edges.Len(), 1, 2, true))
+	busyDone := make(chan struct{})
+	go func() {
+		busy.FindNext(slowReject{Delay: 700 * time.Millisecond})
+		close(busyDone)
+	}()
+	time.Sleep(100 * time.Millisecond) // the busy search is searching its first request by now
+
+	other := cloudlib.DistSearchGen{RunID: "other", Logger: quiet, Dispatcher: dispatcher}.
+		GetSearch(&graph, &graph.Edges, 2, lib.SplitCombin(graph.Edges.Len(), 1, 1, true))
+	otherDone := make(chan struct{})
+	go func() {
+		other.FindNext(lib.BalancedCheck{})
+		close(otherDone)
+	}()
+
+	// the busy search takes seconds for its first request
+	select {
+	case <-otherDone:
+	case <-time.After(time.Second):
+		t.Error("the answer of a search was held up by a search busy with its own")
+	}
+	select {
+	case <-busyDone:
+		t.Error("the busy search ended early, the test does not cover it")
+	default:
+	}
+
+	// none of the messages of the busy search were lost, the solution came after all the progress
+	select {
+	case <-busyDone:
+	case <-time.After(20 * time.Second):
+		t.Fatal("busy search still waiting")
+	}
+	if !busy.SearchEnded() || len(busy.GetResult()) != 0 {
+		t.Errorf("expected an exhausted search, got %v", busy.GetResult())
+	}
+}
+
+// signed adds the checksum a worker sends along with a message
+func signed(msg cloudlib.Message) cloudlib.Message {
+	msg.Attributes["crc32c"] = fmt.Sprintf("%08x", crc32.Checksum(msg.Data, crc32.MakeTable(crc32.Castagnoli)))
+	return msg
+}
+
+// flakySend fails to send the first request
+type flakySend struct {
+	cloudlib.Transport
+	failed int32
+}
+
+func (f *flakySend) Send(ctx context.Context, msg cloudlib.Message) error {
+	if atomic.CompareAndSwapInt32(&f.failed, 0, 1) {
+		return errors.New("transient failure")
+	}
+
+	return f.Transport.Send(ctx, msg)
+}
+
+func TestUnanswerableRequestsSearchedLocally(t *testing.T) {
+	// no single edge of the cycle is a balanced separator, so every generator has to be exhausted
+	dat, err := ioutil.ReadFile("testdata/cycle6.hg")
+	if err != nil {
+		t.Fatal(err)
+	}
+	graph, _ := lib.GetGraph(string(dat))
+
+	// answers every request with its generator exhausted, unless garbled is set and it is the first
+	answering := func(garbled bool) *scriptedTransport {
+		var requests int32
+		transport := &scriptedTransport{messages: make(chan cloudlib.Message, 1024)}
+		transport.reply = func(req cloudlib.Request) []cloudlib.Message {
+			if !garbled || atomic.AddInt32(&requests, 1) > 1 {
+				return []cloudlib.Message{scripted(t, req.ID, cloudlib.Solution{ID: req.ID, Gen: req.Gen})}
+			}
+
+			// garbage with the right checksum, also for a request nobody waits for
+			garbage := []byte("not a solution")
+			return []cloudlib.Message{
+				signed(cloudlib.Message{Data: garbage, Attributes: map[string]string{"request": "unknown"}}),
+				signed(cloudlib.Message{Data: garbage, Attributes: map[string]string{"request": req.ID}}),
+			}
+		}
+		return transport
+	}
+
+	for name, transport := range map[string]cloudlib.Transport{
+		"undecodable": answering(true),
+		"unpublished": &flakySend{Transport: answering(false)},
+	} {
+		dispatcher := &cloudlib.Dispatcher{Transport: transport, Logger: quiet}
+		stats := &cloudlib.RunStats{}
+		search := cloudlib.DistSearchGen{Stats: stats, Logger: quiet, Dispatcher: dispatcher}.
+			GetSearch(&graph, &graph.Edges, 2, lib.SplitCombin(graph.Edges.Len(), 1, 2, true)).(*cloudlib.DistributedSearch)
+
+		done := make(chan struct{})
+		go func() {
+			search.FindNext(lib.BalancedCheck{})
+			close(done)
+		}()
+		select {
+		case <-done:
+		case <-time.After(10 * time.Second):
+			t.Fatalf("%s: search still waiting", name)
+		}
+		dispatcher.Close()
+
+		if search.Err != nil || !search.SearchEnded() || len(search.GetResult()) != 0 {
+			t.Errorf("%s: expected an exhausted search, got %v (%v)", name, search.GetResult(), search.Err)
+		}
+		if summary := stats.Summary(); summary.Failed != 0 || summary.Solutions != 2 {
+			t.Errorf("%s: expected a solution for each generator, and no failure: %+v", name, summary)
+		}
+	}
+}
@@ -0,0 +1,147 @@
+package test
+
+import (
+	"context"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"cloud.google.com/go/pubsub"
+	"cloud.google.com/go/pubsub/pstest"
+	algo "github.com/cem-okulmus/BalancedGo/algorithms"
+	"github.com/cem-okulmus/BalancedGo/lib"
+	cloudlib "github.com/cem-okulmus/GHDDistributedSearch/lib"
+	"google.golang.org/api/option"
+	"google.golang.org/grpc"
+)
+
+// harness connects a master to a real worker loop through Pub/Sub. It uses the emulator if
+// PUBSUB_EMULATOR_HOST is set, otherwise an in-process fake server.
+type harness struct {
+	RunID      string
+	Dispatcher *cloudlib.Dispatcher
+}
+
+// newHarness sets up the topics, a worker and the master side of a run, all torn down at the
+// end of the test
+func newHarness(t *testing.T) *harness {
+	ctx := context.Background()
+	projectID := "integration-test"
+
+	var opts []option.ClientOption
+	if os.Getenv("PUBSUB_EMULATOR_HOST") == "" {
+		srv := pstest.NewServer()
+		t.Cleanup(func() { srv.Close() })
+
+		// every client dials its own connection, so closing one leaves the others working
+		opts = append(opts, option.WithEndpoint(srv.Addr), option.WithoutAuthentication(),
+			option.WithGRPCDialOption(grpc.WithInsecure()))
+	}
+
+	client, err := pubsub.NewClient(ctx, projectID, opts...)
+	if err != nil {
+		t.Fatal("creating client: ", err)
+	}
+	t.Cleanup(func() { client.Close() })
+
+	topology := cloudlib.DefaultTopology
+	topology.AnswerSubscription = "" // the answers are received on a subscription of the run
+
+	runID := cloudlib.NewRunID()
+	subID, teardown, err := topology.Provision(ctx, client, runID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { teardown(context.Background()) })
+
+	quiet := cloudlib.NewLogger(ioutil.Discard, cloudlib.LevelOff)
+
+	// the worker loop, as run by the standalone worker
+	worker := cloudlib.NewWorker(quiet)
+	answers := client.Topic(topology.AnswerTopic)
+	answers.PublishSettings.DelayThreshold = time.Millisecond
+
+	wctx, stop := context.WithCancel(ctx)
+	served := make(chan struct{})
+	go func() {
+		defer close(served)
+		if err := worker.Serve(wctx, client.Subscription(topology.WorkerSubscription), answers); err != nil {
+			t.Error("worker: ", err)
+		}
+	}()
+	t.Cleanup(func() {
+		stop()
+		<-served
+		answers.Stop()
+	})
+
+	settings := pubsub.DefaultPublishSettings
+	settings.DelayThreshold = time.Millisecond
+	dispatcher := &cloudlib.Dispatcher{
+		Transport: &cloudlib.PubSubTransport{
+			ProjectID:      projectID,
+			TopicID:        topology.RequestTopic,
+			SubscriptionID: subID,
+			Settings:       &settings,
+			Options:        opts,
+		},
+		Logger: quiet,
+	}
+	t.Cleanup(func() { dispatcher.Close() }) // runs before the subscription is deleted
+
+	return &harness{RunID: runID, Dispatcher: dispatcher}
+}
+
+// generator produces the search generator sending all searches through the harness
+func (h *harness) generator(stats *cloudlib.RunStats) cloudlib.DistSearchGen {
+	return cloudlib.DistSearchGen{
+		Stats:      stats,
+		Logger:     cloudlib.NewLogger(ioutil.Discard, cloudlib.LevelOff),
+		RunID:      h.RunID,
+		Dispatcher: h.Dispatcher,
+	}
+}
+
+// compareWithLocal decomposes the sample hypergraphs with the given search, and checks that the
+// same widths are found as with the local search of BalancedGo
+func compareWithLocal(t *testing.T, search func(stats *cloudlib.RunStats) lib.SearchGenerator) {
+	log.SetOutput(ioutil.Discard) // the algorithms of BalancedGo trace their progress here
+	defer log.SetOutput(os.Stderr)
+
+	files, err := filepath.Glob(filepath.Join("testdata", "*.hg"))
+	if err != nil || len(files) == 0 {
+		t.Fatal("no sample hypergraphs found: ", err)
+	}
+
+	for _, file := range files {
+		dat, err := ioutil.ReadFile(file)
+		if err != nil {
+			t.Fatal(err)
+		}
+		graph, _ := lib.GetGraph(string(dat))
+
+		for k := 1; k <= 3; k++ {
+			local := algo.LogKDecomp{Graph: graph, K: k, BalFactor: 2}
+			local.SetGenerator(lib.ParallelSearchGen{})
+			expected := local.FindDecomp()
+
+			stats := &cloudlib.RunStats{}
+			remote := algo.LogKDecomp{Graph: graph, K: k, BalFactor: 2}
+			remote.SetGenerator(search(stats))
+			decomp := remote.FindDecomp()
+
+			found := decomp.Correct(graph)
+			if found != expected.Correct(graph) {
+				t.Errorf("%s, width %d: distributed search found a decomposition: %v, local search: %v",
+					file, k, found, !found)
+			}
+
+			if stats.Summary().Solutions == 0 {
+				t.Errorf("%s, width %d: no solution received from the worker", file, k)
+			}
+		}
+	}
+}
@@ -0,0 +1,154 @@
+package test
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"strings"
+	"testing"
+
+	algo "github.com/cem-okulmus/BalancedGo/algorithms"
+	"github.com/cem-okulmus/BalancedGo/lib"
+	cloudlib "github.com/cem-okulmus/GHDDistributedSearch/lib"
+)
+
+// entries decodes the log entries written to the buffer, one JSON object per line
+func entries(t *testing.T, buffer *bytes.Buffer) []map[string]interface{} {
+	var out []map[string]interface{}
+
+	scanner := bufio.NewScanner(bytes.NewReader(buffer.Bytes()))
+	for scanner.Scan() {
+		var entry map[string]interface{}
+		if err := json.Unmarshal(scanner.Bytes(), &entry); err != nil {
+			t.Fatalf("log entry is not JSON: %v\n%s", err, scanner.Text())
+		}
+		out = append(out, entry)
+	}
+
+	return out
+}
+
+func TestLoggerLevelsAndFields(t *testing.T) {
+	var buffer bytes.Buffer
+	logger := cloudlib.NewLogger(&buffer, cloudlib.LevelInfo).With("run", "r1")
+
+	logger.Debug("hidden")
+	logger.With("request", "q1").Info("shown", "subgraph", 5, "error", errors.New("failed"))
+	logger.Error("also shown")
+
+	logged := entries(t, &buffer)
+	if len(logged) != 2 {
+		t.Fatalf("expected 2 entries at level info, got %d", len(logged))
+	}
+
+	first := logged[0]
+	if first["severity"] != "INFO" || first["message"] != "shown" {
+		t.Errorf("wrong severity or message: %v", first)
+	}
+	if first["run"] != "r1" || first["request"] != "q1" || first["subgraph"] != 5.0 || first["error"] != "failed" {
+		t.Errorf("wrong fields: %v", first)
+	}
+	if _, ok := first["time"]; !ok {
+		t.Errorf("no time: %v", first)
+	}
+
+	// fields added to a derived logger do not leak back
+	if second := logged[1]; second["severity"] != "ERROR" || second["run"] != "r1" || second["request"] != nil {
+		t.Errorf("wrong entry: %v", second)
+	}
+
+	buffer.Reset()
+	cloudlib.NewLogger(&buffer, cloudlib.LevelOff).Error("dropped")
+	var nilLogger *cloudlib.Logger
+	nilLogger.With("run", "r1").Error("dropped")
+	if buffer.Len() != 0 {
+		t.Errorf("disabled logger wrote %q", buffer.String())
+	}
+}
+
+func TestParseLevel(t *testing.T) {
+	for name, level := range map[string]cloudlib.Level{
+		"debug":   cloudlib.LevelDebug,
+		"INFO":    cloudlib.LevelInfo,
+		"warning": cloudlib.LevelWarn,
+		"warn":    cloudlib.LevelWarn,
+		"error":   cloudlib.LevelError,
+		"off":     cloudlib.LevelOff,
+	} {
+		if parsed, err := cloudlib.ParseLevel(name); err != nil || parsed != level {
+			t.Errorf("%s parsed as %v (%v)", name, parsed, err)
+		}
+	}
+
+	if _, err := cloudlib.ParseLevel("verbose"); err == nil {
+		t.Error("unknown level accepted")
+	}
+}
+
+func TestLoggerWriter(t *testing.T) {
+	var buffer bytes.Buffer
+	logger := cloudlib.NewLogger(&buffer, cloudlib.LevelInfo)
+
+	fmt.Fprint(logger.Writer(cloudlib.LevelWarn), "first line\n\n  second line  \n")
+	fmt.Fprint(logger.Writer(cloudlib.LevelDebug), "below the level\n")
+
+	logged := entries(t, &buffer)
+	if len(logged) != 2 {
+		t.Fatalf("expected 2 entries, got %d", len(logged))
+	}
+	for i, msg := range []string{"first line", "second line"} {
+		if logged[i]["message"] != msg || logged[i]["severity"] != "WARNING" {
+			t.Errorf("wrong entry: %v", logged[i])
+		}
+	}
+}
+
+func TestSearchLogsCarryIDs(t *testing.T) {
+	log.SetOutput(ioutil.Discard)
+	defer log.SetOutput(os.Stderr)
+
+	var buffer bytes.Buffer
+	logger := cloudlib.NewLogger(&buffer, cloudlib.LevelDebug)
+
+	dispatcher := &cloudlib.Dispatcher{
+		Transport: &cloudlib.SimTransport{Model: cloudlib.DefaultLatencyModel, Worker: cloudlib.NewWorker(quiet)},
+		Logger:    quiet,
+	}
+	defer dispatcher.Close()
+
+	dat, err := ioutil.ReadFile("testdata/grid3.hg")
+	if err != nil {
+		t.Fatal(err)
+	}
+	graph, _ := lib.GetGraph(string(dat))
+	solver := algo.LogKDecomp{Graph: graph, K: 2, BalFactor: 2}
+	solver.SetGenerator(cloudlib.DistSearchGen{Logger: logger, RunID: "run-logged", Dispatcher: dispatcher})
+	if !solver.FindDecomp().Correct(graph) {
+		t.Fatal("no correct decomposition found")
+	}
+
+	var received int
+	for _, entry := range entries(t, &buffer) {
+		if entry["run"] != "run-logged" {
+			t.Errorf("entry without the run: %v", entry)
+		}
+		if _, ok := entry["subgraph"]; !ok {
+			t.Errorf("entry without the subgraph: %v", entry)
+		}
+		if entry["message"] != "Received solution" {
+			continue
+		}
+		received++
+		if request, _ := entry["request"].(string); !strings.HasPrefix(request, "run-logged") {
+			t.Errorf("solution logged without its request: %v", entry)
+		}
+	}
+	if received == 0 {
+		t.Error("no solution logged")
+	}
+}
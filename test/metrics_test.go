@@ -0,0 +1,97 @@
+package test
+
+import (
+	"bufio"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	algo "github.com/cem-okulmus/BalancedGo/algorithms"
+	"github.com/cem-okulmus/BalancedGo/lib"
+	cloudlib "github.com/cem-okulmus/GHDDistributedSearch/lib"
+)
+
+// scrape reads the metrics exposed at the address, by name and labels as printed
+func scrape(t *testing.T, addr string) map[string]float64 {
+	var resp *http.Response
+	var err error
+	for deadline := time.Now().Add(5 * time.Second); ; time.Sleep(10 * time.Millisecond) {
+		if resp, err = http.Get("http://" + addr + "/metrics"); err == nil || time.Now().After(deadline) {
+			break
+		}
+	}
+	if err != nil {
+		t.Fatal("metrics not exposed: ", err)
+	}
+	defer resp.Body.Close()
+
+	metrics := make(map[string]float64)
+	scanner := bufio.NewScanner(resp.Body)
+	for scanner.Scan() {
+		line := scanner.Text()
+		if strings.HasPrefix(line, "#") {
+			continue
+		}
+		i := strings.LastIndex(line, " ")
+		if value, err := strconv.ParseFloat(line[i+1:], 64); err == nil {
+			metrics[line[:i]] = value
+		}
+	}
+
+	return metrics
+}
+
+func TestMetricsExposed(t *testing.T) {
+	log.SetOutput(ioutil.Discard)
+	defer log.SetOutput(os.Stderr)
+
+	addr := freeAddrs(t, 1)[0]
+	cloudlib.ServeMetrics(addr)
+	before := scrape(t, addr)
+
+	// master and worker run in this process, so both record their metrics
+	dispatcher := &cloudlib.Dispatcher{
+		Transport: &cloudlib.SimTransport{Model: cloudlib.DefaultLatencyModel, Worker: cloudlib.NewWorker(quiet)},
+		Logger:    quiet,
+	}
+	defer dispatcher.Close()
+
+	dat, err := ioutil.ReadFile("testdata/grid3.hg")
+	if err != nil {
+		t.Fatal(err)
+	}
+	graph, _ := lib.GetGraph(string(dat))
+	solver := algo.LogKDecomp{Graph: graph, K: 2, BalFactor: 2}
+	solver.SetGenerator(cloudlib.DistSearchGen{Logger: quiet, Dispatcher: dispatcher})
+	if !solver.FindDecomp().Correct(graph) {
+		t.Fatal("no correct decomposition found")
+	}
+
+	after := scrape(t, addr)
+	sent := after["ghd_requests_sent_total"] - before["ghd_requests_sent_total"]
+	if sent == 0 {
+		t.Fatal("no request counted")
+	}
+	received := 0.0
+	for _, outcome := range []string{"valid", "limit", "exhausted"} {
+		name := `ghd_solutions_received_total{outcome="` + outcome + `"}`
+		received += after[name] - before[name]
+	}
+	if handled := after["ghd_worker_requests_total"] - before["ghd_worker_requests_total"]; handled != sent {
+		t.Errorf("%v requests sent, but %v handled by the worker", sent, handled)
+	}
+	if received != sent {
+		t.Errorf("%v requests sent, but %v solutions received", sent, received)
+	}
+	if n := after["ghd_round_trip_seconds_count"] - before["ghd_round_trip_seconds_count"]; n != sent {
+		t.Errorf("%v round trips observed for %v requests", n, sent)
+	}
+	if n := after[`ghd_payload_bytes_count{kind="request"}`] - before[`ghd_payload_bytes_count{kind="request"}`]; n < sent {
+		t.Errorf("%v request payloads observed for %v requests", n, sent)
+	}
+}
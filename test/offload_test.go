@@ -0,0 +1,100 @@
+package test
+
+import (
+	"io/ioutil"
+	"log"
+	"os"
+	"testing"
+
+	algo "github.com/cem-okulmus/BalancedGo/algorithms"
+	"github.com/cem-okulmus/BalancedGo/lib"
+	cloudlib "github.com/cem-okulmus/GHDDistributedSearch/lib"
+)
+
+func TestSearchSpace(t *testing.T) {
+	for _, c := range []struct {
+		edges, k   int
+		unextended bool
+		space      float64
+	}{
+		{edges: 10, k: 2, unextended: true, space: 45},
+		{edges: 10, k: 3, unextended: true, space: 120},
+		{edges: 10, k: 2, space: 55}, // subsets of size 2 and 1
+	} {
+		gens := lib.SplitCombin(c.edges, c.k, 1, c.unextended)
+		if space := cloudlib.SearchSpace(c.edges, gens); space != c.space {
+			t.Errorf("%d choose %d (extended %v): expected %v, got %v", c.edges, c.k, !c.unextended, c.space, space)
+		}
+	}
+
+	if space := cloudlib.SearchSpace(10, nil); space != 0 {
+		t.Errorf("search space without generators: %v", space)
+	}
+}
+
+func TestOffloadDecision(t *testing.T) {
+	dat, err := ioutil.ReadFile("testdata/grid3.hg")
+	if err != nil {
+		t.Fatal(err)
+	}
+	graph, _ := lib.GetGraph(string(dat))
+	m := graph.Edges.Len()
+
+	gens := lib.SplitCombin(m, 2, 1, true)
+	work := cloudlib.EstimateWork(&graph, &graph.Edges, gens)
+	if expected := float64(m*(m-1)/2) * float64(m); work != expected {
+		t.Fatalf("expected work %v, got %v", expected, work)
+	}
+
+	for _, c := range []struct {
+		threshold float64
+		local     bool
+	}{
+		{threshold: 0},
+		{threshold: work},
+		{threshold: work + 1, local: true},
+	} {
+		stats := &cloudlib.RunStats{}
+		search := cloudlib.DistSearchGen{OffloadThreshold: c.threshold, Stats: stats, Logger: quiet}.
+			GetSearch(&graph, &graph.Edges, 2, gens).(*cloudlib.DistributedSearch)
+		if search.Local != c.local {
+			t.Errorf("threshold %v for work %v: expected local %v", c.threshold, work, c.local)
+		}
+
+		summary := stats.Summary()
+		if c.local && (summary.LocalSearches != 1 || summary.RemoteSearches != 0) ||
+			!c.local && (summary.LocalSearches != 0 || summary.RemoteSearches != 1) {
+			t.Errorf("threshold %v: decision not counted: %+v", c.threshold, summary)
+		}
+	}
+}
+
+func TestOffloadThresholdKeepsSearchesLocal(t *testing.T) {
+	log.SetOutput(ioutil.Discard)
+	defer log.SetOutput(os.Stderr)
+
+	dispatcher := &cloudlib.Dispatcher{
+		Transport: &cloudlib.SimTransport{Model: cloudlib.DefaultLatencyModel, Worker: cloudlib.NewWorker(quiet)},
+		Logger:    quiet,
+	}
+	defer dispatcher.Close()
+
+	dat, err := ioutil.ReadFile("testdata/grid3.hg")
+	if err != nil {
+		t.Fatal(err)
+	}
+	graph, _ := lib.GetGraph(string(dat))
+
+	stats := &cloudlib.RunStats{}
+	solver := algo.LogKDecomp{Graph: graph, K: 2, BalFactor: 2}
+	solver.SetGenerator(cloudlib.DistSearchGen{OffloadThreshold: 1e18, Stats: stats, Logger: quiet, Dispatcher: dispatcher})
+	if !solver.FindDecomp().Correct(graph) {
+		t.Fatal("no correct decomposition found")
+	}
+
+	// nothing reaches the workers, so no solution is received
+	summary := stats.Summary()
+	if summary.LocalSearches == 0 || summary.RemoteSearches != 0 || summary.Solutions != 0 {
+		t.Errorf("searches below the threshold were distributed: %+v", summary)
+	}
+}
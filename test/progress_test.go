@@ -0,0 +1,106 @@
+package test
+
+import (
+	"io/ioutil"
+	"log"
+	"os"
+	"reflect"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/cem-okulmus/BalancedGo/lib"
+	cloudlib "github.com/cem-okulmus/GHDDistributedSearch/lib"
+)
+
+// slowReject is a predicate taking its time to reject every separator
+type slowReject struct {
+	Delay time.Duration
+}
+
+func (s slowReject) Check(H *lib.Graph, sep *lib.Edges, balFactor int) bool {
+	time.Sleep(s.Delay)
+	return false
+}
+
+func TestHeartbeatsResumeLostRequest(t *testing.T) {
+	log.SetOutput(ioutil.Discard)
+	defer log.SetOutput(os.Stderr)
+
+	// the worker of the first request dies after reporting its progress twice
+	var mux sync.Mutex
+	var reported []cloudlib.Progress
+	transport := &localTransport{worker: cloudlib.NewWorker(quiet)}
+	transport.filter = func(n int, msg cloudlib.Message) disposition {
+		if n != 0 {
+			return pass
+		}
+
+		mux.Lock()
+		defer mux.Unlock()
+		if !cloudlib.IsProgress(msg.Attributes) || len(reported) == 2 {
+			return drop
+		}
+		p, err := cloudlib.DecodeProgress(msg.Data)
+		if err != nil {
+			t.Error(err)
+			return drop
+		}
+		reported = append(reported, p)
+		return pass
+	}
+	dispatcher := &cloudlib.Dispatcher{Transport: transport, Logger: quiet}
+	defer dispatcher.Close()
+
+	dat, err := ioutil.ReadFile("testdata/cycle6.hg")
+	if err != nil {
+		t.Fatal(err)
+	}
+	graph, _ := lib.GetGraph(string(dat))
+
+	stats := &cloudlib.RunStats{}
+	gen := cloudlib.DistSearchGen{
+		Heartbeats: &cloudlib.Heartbeats{Interval: 20 * time.Millisecond, Timeout: 200 * time.Millisecond},
+		Stats:      stats,
+		Logger:     quiet,
+		Dispatcher: dispatcher,
+	}
+	search := gen.GetSearch(&graph, &graph.Edges, 2, lib.SplitCombin(graph.Edges.Len(), 2, 1, true))
+
+	done := make(chan struct{})
+	go func() {
+		search.FindNext(slowReject{Delay: 10 * time.Millisecond})
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(20 * time.Second):
+		t.Fatal("search waited for the lost worker")
+	}
+
+	if !search.SearchEnded() || len(search.GetResult()) != 0 {
+		t.Errorf("expected an exhausted search, got %v", search.GetResult())
+	}
+
+	requests := transport.sent()
+	if len(requests) != 2 {
+		t.Fatalf("expected the lost request to be sent again once, %d requests sent", len(requests))
+	}
+
+	// the request is resumed where the last progress report left it
+	mux.Lock()
+	defer mux.Unlock()
+	if len(reported) != 2 || reported[1].Candidates <= reported[0].Candidates {
+		t.Fatalf("expected two progress reports, got %+v", reported)
+	}
+	resumed, err := cloudlib.DecodeRequest(requests[1].Data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(resumed.Gen, reported[1].Gen) {
+		t.Errorf("request resumed from %+v instead of the last report %+v", resumed.Gen, reported[1].Gen)
+	}
+	if summary := stats.Summary(); summary.Solutions != 1 {
+		t.Errorf("expected only the solution of the resumed request: %+v", summary)
+	}
+}
@@ -0,0 +1,248 @@
+package test
+
+import (
+	"context"
+	"net"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"cloud.google.com/go/pubsub"
+	"cloud.google.com/go/pubsub/pstest"
+	"github.com/cem-okulmus/BalancedGo/lib"
+	cloudlib "github.com/cem-okulmus/GHDDistributedSearch/lib"
+	"google.golang.org/api/option"
+	"google.golang.org/grpc"
+)
+
+// fakePubSub starts an in-process Pub/Sub server with the topics of the default topology. It
+// returns the server, and options connecting a client to it which count the connections dialed.
+func fakePubSub(t *testing.T, dials *int32) (*pstest.Server, []option.ClientOption) {
+	srv := pstest.NewServer()
+	t.Cleanup(func() { srv.Close() })
+
+	opts := []option.ClientOption{
+		option.WithEndpoint(srv.Addr),
+		option.WithoutAuthentication(),
+		option.WithGRPCDialOption(grpc.WithInsecure()),
+		option.WithGRPCDialOption(grpc.WithContextDialer(func(ctx context.Context, addr string) (net.Conn, error) {
+			atomic.AddInt32(dials, 1)
+			return (&net.Dialer{}).DialContext(ctx, "tcp", addr)
+		})),
+	}
+
+	client, err := pubsub.NewClient(context.Background(), "pubsub-test", opts[:3]...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+	if err = cloudlib.DefaultTopology.EnsureTopics(context.Background(), client); err != nil {
+		t.Fatal(err)
+	}
+
+	return srv, opts
+}
+
+func TestPubSubTransportReusesClient(t *testing.T) {
+	var dials int32
+	srv, opts := fakePubSub(t, &dials)
+
+	transport := &cloudlib.PubSubTransport{
+		ProjectID:      "pubsub-test",
+		TopicID:        cloudlib.DefaultTopology.RequestTopic,
+		SubscriptionID: cloudlib.DefaultTopology.AnswerSubscription,
+		Options:        opts,
+	}
+
+	// nothing is connected before the first use, and there is nothing to close
+	if err := transport.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if n := atomic.LoadInt32(&dials); n != 0 {
+		t.Fatalf("%d connections dialed before the first use", n)
+	}
+
+	send := func() {
+		if err := transport.Send(context.Background(), cloudlib.Message{Data: []byte("request")}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	send()
+	time.Sleep(100 * time.Millisecond) // the connections of the client are dialed in the background
+	connected := atomic.LoadInt32(&dials)
+	if connected == 0 {
+		t.Fatal("no connection dialed")
+	}
+
+	for i := 0; i < 20; i++ {
+		send()
+	}
+	if n := atomic.LoadInt32(&dials); n != connected {
+		t.Errorf("later requests dialed %d more connections", n-connected)
+	}
+	if n := len(srv.Messages()); n != 21 {
+		t.Errorf("expected 21 requests published, got %d", n)
+	}
+
+	// a closed transport connects again on its next use
+	if err := transport.Close(); err != nil {
+		t.Fatal(err)
+	}
+	send()
+	if n := atomic.LoadInt32(&dials); n == connected {
+		t.Error("no connection dialed after closing")
+	}
+	if err := transport.Close(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestPubSubTransportSettings(t *testing.T) {
+	var dials int32
+	srv, opts := fakePubSub(t, &dials)
+
+	// requests are held back for a batch far longer than the test runs
+	settings := pubsub.DefaultPublishSettings
+	settings.DelayThreshold = time.Hour
+	settings.CountThreshold = 100
+	transport := &cloudlib.PubSubTransport{
+		ProjectID: "pubsub-test",
+		TopicID:   cloudlib.DefaultTopology.RequestTopic,
+		Settings:  &settings,
+		Options:   opts,
+	}
+
+	sent := make(chan error, 1)
+	go func() {
+		sent <- transport.Send(context.Background(), cloudlib.Message{Data: []byte("request")})
+	}()
+
+	select {
+	case err := <-sent:
+		t.Fatal("request published right away, the settings were ignored: ", err)
+	case <-time.After(200 * time.Millisecond):
+	}
+	if n := len(srv.Messages()); n != 0 {
+		t.Fatalf("%d requests published before the batch was full", n)
+	}
+
+	// closing flushes the batch
+	if err := transport.Close(); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case err := <-sent:
+		if err != nil {
+			t.Fatal(err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("request not flushed by closing")
+	}
+	if n := len(srv.Messages()); n != 1 {
+		t.Errorf("expected the request to be published, got %d messages", n)
+	}
+}
+
+func TestRunSubscriptionAndAttributes(t *testing.T) {
+	var dials int32
+	srv, opts := fakePubSub(t, &dials)
+	ctx := context.Background()
+
+	client, err := pubsub.NewClient(ctx, "pubsub-test", opts...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+
+	// the run receives its answers on a subscription of its own, filtered by its ID
+	topology := cloudlib.DefaultTopology
+	runID := cloudlib.NewRunID()
+	subID, teardown, err := topology.SubscribeRun(ctx, client, runID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if subID != topology.RunSubscription(runID) {
+		t.Errorf("subscription %s is not named after the run", subID)
+	}
+	cfg, err := client.Subscription(subID).Config(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cfg.Filter != `attributes.run = "`+runID+`"` || cfg.Labels["run"] != runID {
+		t.Errorf("subscription not filtered by the run: filter %q, labels %v", cfg.Filter, cfg.Labels)
+	}
+	if cfg.Topic.ID() != topology.AnswerTopic || cfg.ExpirationPolicy != 24*time.Hour {
+		t.Errorf("wrong topic %s or expiry %v", cfg.Topic.ID(), cfg.ExpirationPolicy)
+	}
+
+	// by default, the runs share a subscription receiving all answers
+	shared, err := client.Subscription(topology.AnswerSubscription).Config(ctx)
+	if err != nil || shared.Filter != "" {
+		t.Errorf("shared subscription filtered by %q (%v)", shared.Filter, err)
+	}
+
+	wctx, stop := context.WithCancel(ctx)
+	served := make(chan struct{})
+	answerTopic := client.Topic(topology.AnswerTopic)
+	answerTopic.PublishSettings.DelayThreshold = time.Millisecond
+	go func() {
+		defer close(served)
+		cloudlib.NewWorker(quiet).Serve(wctx, client.Subscription(topology.WorkerSubscription), answerTopic)
+	}()
+	defer func() {
+		stop()
+		<-served
+		answerTopic.Stop()
+	}()
+
+	settings := pubsub.DefaultPublishSettings
+	settings.DelayThreshold = time.Millisecond
+	dispatcher := &cloudlib.Dispatcher{
+		Transport: &cloudlib.PubSubTransport{
+			ProjectID:      "pubsub-test",
+			TopicID:        topology.RequestTopic,
+			SubscriptionID: subID,
+			Settings:       &settings,
+			Options:        opts,
+		},
+		Logger: quiet,
+	}
+	defer dispatcher.Close()
+
+	graph, _ := getRandomGraph(8)
+	search := cloudlib.DistSearchGen{RunID: runID, Logger: quiet, Dispatcher: dispatcher}.
+		GetSearch(&graph, &graph.Edges, 2, lib.SplitCombin(graph.Edges.Len(), 2, 2, false))
+	done := make(chan struct{})
+	go func() {
+		search.FindNext(lib.BalancedCheck{})
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(20 * time.Second):
+		t.Fatal("no answers received on the subscription of the run")
+	}
+
+	// the requests and all answers of the workers carry the IDs of the run and request
+	var requests, answers int
+	for _, msg := range srv.Messages() {
+		if msg.Attributes["run"] != runID || msg.Attributes["request"] == "" {
+			t.Errorf("message without the IDs of its run and request: %v", msg.Attributes)
+		}
+		if req, err := cloudlib.DecodeRequest(msg.Data); err == nil && req.Subgraph.Edges.Len() > 0 {
+			requests++
+		} else {
+			answers++
+		}
+	}
+	if requests == 0 || answers == 0 {
+		t.Errorf("%d requests and %d answers published", requests, answers)
+	}
+
+	if err = teardown(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if ok, err := client.Subscription(subID).Exists(ctx); err != nil || ok {
+		t.Errorf("subscription of the run not deleted (%v)", err)
+	}
+}
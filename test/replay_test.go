@@ -0,0 +1,89 @@
+package test
+
+import (
+	"io/ioutil"
+	"log"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	algo "github.com/cem-okulmus/BalancedGo/algorithms"
+	"github.com/cem-okulmus/BalancedGo/lib"
+	cloudlib "github.com/cem-okulmus/GHDDistributedSearch/lib"
+)
+
+func TestReplayCaptured(t *testing.T) {
+	if testing.Short() {
+		t.Skip("skipping replay test in short mode")
+	}
+	replay := buildCommand(t, "../replay", "replay")
+
+	log.SetOutput(ioutil.Discard)
+	defer log.SetOutput(os.Stderr)
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	serveTCP(t, listener)
+
+	dir := t.TempDir()
+	capture := &cloudlib.CaptureTransport{
+		Transport: &cloudlib.TCPTransport{Addrs: []string{listener.Addr().String()}, Logger: quiet},
+		Dir:       dir,
+		Logger:    quiet,
+	}
+	dispatcher := &cloudlib.Dispatcher{Transport: capture, Logger: quiet}
+	defer dispatcher.Close()
+
+	dat, err := ioutil.ReadFile("testdata/grid3.hg")
+	if err != nil {
+		t.Fatal(err)
+	}
+	graph, _ := lib.GetGraph(string(dat))
+	solver := algo.LogKDecomp{Graph: graph, K: 2, BalFactor: 2}
+	solver.SetGenerator(cloudlib.DistSearchGen{Logger: quiet, Dispatcher: dispatcher})
+	if !solver.FindDecomp().Correct(graph) {
+		t.Fatal("no correct decomposition found")
+	}
+
+	// every request whose solution was captured produces the same solution again
+	files, err := filepath.Glob(filepath.Join(dir, "*.req"))
+	if err != nil || len(files) == 0 {
+		t.Fatal("no requests captured: ", err)
+	}
+	out, exit := runCLI(t, replay, files...)
+	if exit != 0 {
+		t.Fatalf("replay failed with exit code %d:\n%s", exit, out)
+	}
+	solutions, err := filepath.Glob(filepath.Join(dir, "*.sol"))
+	if err != nil || len(solutions) == 0 {
+		t.Fatal("no solutions captured: ", err)
+	}
+	if n := strings.Count(out, "Matches the captured solution"); n != len(solutions) {
+		t.Errorf("%d of %d captured solutions matched:\n%s", n, len(solutions), out)
+	}
+
+	// a request which a worker would reject, as captured by an older version, only runs unchecked
+	data, err := ioutil.ReadFile(files[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	req, err := cloudlib.DecodeRequest(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.ID = ""
+	old := filepath.Join(t.TempDir(), "old.req")
+	if err = ioutil.WriteFile(old, encodeRequest(t, req), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if out, exit = runCLI(t, replay, old); exit != 1 || !strings.Contains(out, "-unchecked") {
+		t.Errorf("invalid request not rejected with a hint, exit code %d:\n%s", exit, out)
+	}
+	if out, exit = runCLI(t, replay, "-unchecked", old); exit != 0 || !strings.Contains(out, "Valid: ") {
+		t.Errorf("invalid request not run unchecked, exit code %d:\n%s", exit, out)
+	}
+}
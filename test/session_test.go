@@ -0,0 +1,145 @@
+package test
+
+import (
+	"context"
+	"io/ioutil"
+	"log"
+	"net"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	algo "github.com/cem-okulmus/BalancedGo/algorithms"
+	"github.com/cem-okulmus/BalancedGo/lib"
+	cloudlib "github.com/cem-okulmus/GHDDistributedSearch/lib"
+)
+
+func TestSessionLifecycle(t *testing.T) {
+	worker := cloudlib.NewWorker(cloudlib.NewLogger(ioutil.Discard, cloudlib.LevelOff))
+
+	handle := func(req cloudlib.Request) (cloudlib.Solution, error) {
+		out, _, err := worker.Handle(context.Background(), encodeRequest(t, req), nil, nil)
+		if err != nil {
+			return cloudlib.Solution{}, err
+		}
+		return cloudlib.DecodeSolution(out)
+	}
+
+	opening := validRequest()
+	opening.ID = "open"
+	opening.Session = "session"
+
+	later := opening
+	later.ID = "later"
+	later.Subgraph, later.Edges = lib.Graph{}, lib.Edges{}
+
+	// a session which was never opened cannot be searched
+	sol, err := handle(later)
+	if err != nil || !sol.SessionLost {
+		t.Fatalf("request of unknown session was not answered with SessionLost: %+v, %v", sol, err)
+	}
+
+	sol, err = handle(opening)
+	if err != nil || sol.Error != "" || sol.SessionLost || sol.GraphCached {
+		t.Fatalf("opening the session failed: %+v, %v", sol, err)
+	}
+
+	later.ID = "later-1"
+	sol, err = handle(later)
+	if err != nil || sol.Error != "" || !sol.GraphCached {
+		t.Fatalf("request did not use the graph of the session: %+v, %v", sol, err)
+	}
+
+	_, err = handle(cloudlib.Request{ID: "close", Session: "session", Close: true})
+	if err != cloudlib.ErrNoReply {
+		t.Fatal("closing the session was answered: ", err)
+	}
+
+	later.ID = "later-2"
+	sol, err = handle(later)
+	if err != nil || !sol.SessionLost {
+		t.Fatalf("request of closed session was not answered with SessionLost: %+v, %v", sol, err)
+	}
+}
+
+// sessionRecorder keeps track of the sessions opened and closed by the requests sent
+type sessionRecorder struct {
+	cloudlib.Transport
+
+	mux      sync.Mutex
+	open     map[string]bool
+	requests int // sent, not counting those closing a session
+}
+
+func (s *sessionRecorder) Send(ctx context.Context, msg cloudlib.Message) error {
+	s.mux.Lock()
+	if session := msg.Attributes["session"]; msg.Attributes["type"] == "close" {
+		delete(s.open, session)
+	} else {
+		s.open[session] = true
+		s.requests++
+	}
+	s.mux.Unlock()
+
+	return s.Transport.Send(ctx, msg)
+}
+
+func TestSessionsClosedAndCaptured(t *testing.T) {
+	log.SetOutput(ioutil.Discard)
+	defer log.SetOutput(os.Stderr)
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	serveTCP(t, listener)
+
+	dir := t.TempDir()
+	capture := &cloudlib.CaptureTransport{
+		Transport: &cloudlib.TCPTransport{Addrs: []string{listener.Addr().String()}, Logger: quiet},
+		Dir:       dir,
+		Logger:    quiet,
+	}
+	recorder := &sessionRecorder{Transport: capture, open: make(map[string]bool)}
+	dispatcher := &cloudlib.Dispatcher{Transport: recorder, Logger: quiet}
+	defer dispatcher.Close()
+
+	dat, err := ioutil.ReadFile("testdata/grid3.hg")
+	if err != nil {
+		t.Fatal(err)
+	}
+	graph, _ := lib.GetGraph(string(dat))
+
+	// most searches end with a separator, before their generators are exhausted
+	chunks := cloudlib.NewChunkSizer(time.Millisecond, 5)
+	chunks.Max = 5
+	solver := algo.LogKDecomp{Graph: graph, K: 2, BalFactor: 2}
+	solver.SetGenerator(cloudlib.DistSearchGen{Logger: quiet, Dispatcher: dispatcher, Chunks: chunks, Sessions: true})
+	if decomp := solver.FindDecomp(); !decomp.Correct(graph) {
+		t.Fatal("no correct decomposition found")
+	}
+
+	if len(recorder.open) > 0 {
+		t.Errorf("%d sessions left open", len(recorder.open))
+	}
+
+	// every request can be replayed, including those sent without the graph
+	files, err := filepath.Glob(filepath.Join(dir, "*.req"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(files) != recorder.requests {
+		t.Errorf("%d of %d requests captured", len(files), recorder.requests)
+	}
+	for _, file := range files {
+		data, err := ioutil.ReadFile(file)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err = cloudlib.DecodeRequest(data); err != nil {
+			t.Errorf("captured request %s cannot be replayed: %v", filepath.Base(file), err)
+		}
+	}
+}
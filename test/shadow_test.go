@@ -0,0 +1,45 @@
+package test
+
+import (
+	"io/ioutil"
+	"log"
+	"os"
+	"testing"
+
+	algo "github.com/cem-okulmus/BalancedGo/algorithms"
+	"github.com/cem-okulmus/BalancedGo/lib"
+	cloudlib "github.com/cem-okulmus/GHDDistributedSearch/lib"
+)
+
+func TestShadowAgrees(t *testing.T) {
+	log.SetOutput(ioutil.Discard)
+	defer log.SetOutput(os.Stderr)
+
+	dat, err := ioutil.ReadFile("testdata/cycle6.hg")
+	if err != nil {
+		t.Fatal(err)
+	}
+	graph, _ := lib.GetGraph(string(dat))
+
+	quiet := cloudlib.NewLogger(ioutil.Discard, cloudlib.LevelOff)
+	dispatcher := &cloudlib.Dispatcher{
+		Transport: &cloudlib.SimTransport{Model: cloudlib.DefaultLatencyModel, Worker: cloudlib.NewWorker(quiet)},
+		Logger:    quiet,
+	}
+	defer dispatcher.Close()
+
+	shadow := &cloudlib.Shadow{Dir: t.TempDir()}
+	for k := 1; k <= 2; k++ {
+		solver := algo.LogKDecomp{Graph: graph, K: k, BalFactor: 2}
+		solver.SetGenerator(cloudlib.DistSearchGen{Logger: quiet, Dispatcher: dispatcher, Shadow: shadow})
+		solver.FindDecomp()
+	}
+
+	summary := shadow.Summary()
+	if summary.Compared == 0 {
+		t.Fatal("No search was compared")
+	}
+	if summary.Diverged > 0 {
+		t.Errorf("%d of %d searches diverged from the local search", summary.Diverged, summary.Compared)
+	}
+}
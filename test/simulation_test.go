@@ -0,0 +1,139 @@
+package test
+
+import (
+	"context"
+	"io/ioutil"
+	"log"
+	"os"
+	"runtime"
+	"sync"
+	"testing"
+	"time"
+
+	algo "github.com/cem-okulmus/BalancedGo/algorithms"
+	"github.com/cem-okulmus/BalancedGo/lib"
+	cloudlib "github.com/cem-okulmus/GHDDistributedSearch/lib"
+)
+
+// simulate decomposes a graph with simulated workers, returning the projection of the run
+func simulate(graph lib.Graph, k int, seed int64) (lib.Decomp, cloudlib.SimSummary) {
+	quiet := cloudlib.NewLogger(ioutil.Discard, cloudlib.LevelOff)
+
+	model := cloudlib.DefaultLatencyModel
+	model.Workers = 4
+	sim := &cloudlib.SimTransport{Model: model, Seed: seed, Worker: cloudlib.NewWorker(quiet)}
+	dispatcher := &cloudlib.Dispatcher{Transport: sim, Logger: quiet}
+	defer dispatcher.Close()
+
+	solver := algo.LogKDecomp{Graph: graph, K: k, BalFactor: 2}
+	solver.SetGenerator(cloudlib.DistSearchGen{
+		Logger:     quiet,
+		Dispatcher: dispatcher,
+		Chunks:     cloudlib.NewChunkSizer(model.ColdStart, 5),
+	})
+
+	return solver.FindDecomp(), sim.Summary()
+}
+
+func TestSimulationReproducible(t *testing.T) {
+	log.SetOutput(ioutil.Discard)
+	defer log.SetOutput(os.Stderr)
+
+	dat, err := ioutil.ReadFile("testdata/grid3.hg")
+	if err != nil {
+		t.Fatal(err)
+	}
+	graph, _ := lib.GetGraph(string(dat))
+
+	decomp, first := simulate(graph, 2, 7)
+	if !decomp.Correct(graph) {
+		t.Errorf("Simulated run produced no correct decomposition")
+	}
+	if first.Elapsed <= 0 || first.Requests == 0 {
+		t.Errorf("Simulated run projected no time: %+v", first)
+	}
+
+	if _, second := simulate(graph, 2, 7); second != first {
+		t.Errorf("Runs with the same seed differ:\n%+v\n%+v", first, second)
+	}
+}
+
+func TestSimulationConcurrent(t *testing.T) {
+	log.SetOutput(ioutil.Discard)
+	defer log.SetOutput(os.Stderr)
+
+	// the searches of the subproblems run at the same time, sharing the virtual clock
+	defer runtime.GOMAXPROCS(runtime.GOMAXPROCS(4))
+
+	dat, err := ioutil.ReadFile("testdata/large/grid4.hg")
+	if err != nil {
+		t.Fatal(err)
+	}
+	graph, _ := lib.GetGraph(string(dat))
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for k := 2; k <= 3; k++ {
+			decomp, summary := simulate(graph, k, 7)
+			if found := decomp.Correct(graph); found != (k == 3) {
+				t.Errorf("width %d: simulated run found a decomposition: %v", k, found)
+			}
+			if summary.Requests == 0 {
+				t.Errorf("width %d: no request simulated", k)
+			}
+		}
+	}()
+
+	select {
+	case <-done:
+	case <-time.After(time.Minute):
+		t.Fatal("simulated run did not finish")
+	}
+}
+
+func TestSimulationLimitsConcurrency(t *testing.T) {
+	graph, _ := lib.GetGraph("e1(a,b), e2(b,c).")
+
+	// each request checks a single candidate, taking its time
+	elapsed := func(workers int) time.Duration {
+		model := cloudlib.DefaultLatencyModel
+		model.Workers = workers
+		sim := &cloudlib.SimTransport{Model: model, Worker: cloudlib.NewWorker(quiet)}
+
+		start := time.Now()
+		var wg sync.WaitGroup
+		for i := 0; i < 4; i++ {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				data, err := cloudlib.EncodeRequest(cloudlib.Request{
+					Subgraph:  graph,
+					Edges:     graph.Edges,
+					Predicate: slowReject{Delay: 200 * time.Millisecond},
+					Gen:       lib.SplitCombin(graph.Edges.Len(), 1, 1, true)[0],
+					BalFactor: 2,
+					ID:        cloudlib.NewRunID(),
+					Limit:     1,
+				})
+				if err == nil {
+					err = sim.Send(context.Background(), cloudlib.Message{Data: data})
+				}
+				if err != nil {
+					t.Error(err)
+				}
+			}()
+		}
+		wg.Wait()
+
+		return time.Since(start)
+	}
+
+	// two instances handle the four requests in two rounds, without a limit all run at once
+	if d := elapsed(2); d < 400*time.Millisecond {
+		t.Errorf("four requests on two simulated instances took only %v", d)
+	}
+	if d := elapsed(0); d >= 400*time.Millisecond {
+		t.Errorf("four requests without a limit on the instances took %v", d)
+	}
+}
@@ -0,0 +1,175 @@
+package test
+
+import (
+	"context"
+	"io/ioutil"
+	"log"
+	"os"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/cem-okulmus/BalancedGo/lib"
+	cloudlib "github.com/cem-okulmus/GHDDistributedSearch/lib"
+)
+
+// localTransport hands each request to a worker in this process, and passes its progress and
+// solutions back. The filter, if set, sees every message of the n-th request sent, and decides
+// whether to pass it on, hold it back until release, or drop it.
+type localTransport struct {
+	worker *cloudlib.Worker
+	filter func(n int, msg cloudlib.Message) disposition
+
+	mux      sync.Mutex
+	requests []cloudlib.Message // all requests sent, in order
+	held     []cloudlib.Message
+	messages chan cloudlib.Message
+	once     sync.Once
+}
+
+// disposition tells localTransport what to do with a message of the worker
+type disposition int
+
+const (
+	pass disposition = iota
+	hold
+	drop
+)
+
+func (t *localTransport) init() {
+	t.once.Do(func() { t.messages = make(chan cloudlib.Message, 1024) })
+}
+
+func (t *localTransport) Send(ctx context.Context, msg cloudlib.Message) error {
+	t.init()
+
+	t.mux.Lock()
+	n := len(t.requests)
+	t.requests = append(t.requests, msg)
+	t.mux.Unlock()
+
+	forward := func(reply cloudlib.Message) {
+		d := pass
+		if t.filter != nil {
+			d = t.filter(n, reply)
+		}
+
+		switch d {
+		case pass:
+			t.messages <- reply
+		case hold:
+			t.mux.Lock()
+			t.held = append(t.held, reply)
+			t.mux.Unlock()
+		}
+	}
+
+	go func() {
+		emit := func(data []byte, attrs map[string]string) {
+			forward(cloudlib.Message{Data: append([]byte{}, data...), Attributes: attrs})
+		}
+		data, attrs, err := t.worker.Handle(context.Background(), msg.Data, msg.Attributes, emit)
+		if err == nil {
+			forward(cloudlib.Message{Data: data, Attributes: attrs})
+		}
+	}()
+
+	return nil
+}
+
+func (t *localTransport) Receive(ctx context.Context, handle func(msg cloudlib.Message) bool) error {
+	t.init()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return nil
+		case msg := <-t.messages:
+			handle(msg)
+		}
+	}
+}
+
+func (t *localTransport) Close() error {
+	return nil
+}
+
+// release passes on the messages held back so far
+func (t *localTransport) release() {
+	t.mux.Lock()
+	held := t.held
+	t.held = nil
+	t.mux.Unlock()
+
+	for _, msg := range held {
+		t.messages <- msg
+	}
+}
+
+// sent returns the requests sent so far
+func (t *localTransport) sent() []cloudlib.Message {
+	t.mux.Lock()
+	defer t.mux.Unlock()
+
+	return append([]cloudlib.Message{}, t.requests...)
+}
+
+func TestSpeculation(t *testing.T) {
+	log.SetOutput(ioutil.Discard)
+	defer log.SetOutput(os.Stderr)
+
+	// the first request straggles, until its copy has been sent
+	transport := &localTransport{worker: cloudlib.NewWorker(quiet)}
+	transport.filter = func(n int, msg cloudlib.Message) disposition {
+		switch {
+		case n == 0:
+			return hold
+		case n == 3:
+			defer transport.release() // the original answers right after its copy
+		}
+		return pass
+	}
+	dispatcher := &cloudlib.Dispatcher{Transport: transport, Logger: quiet}
+	defer dispatcher.Close()
+
+	// no single edge of the cycle is a balanced separator, so all three generators are exhausted
+	dat, err := ioutil.ReadFile("testdata/cycle6.hg")
+	if err != nil {
+		t.Fatal(err)
+	}
+	graph, _ := lib.GetGraph(string(dat))
+
+	stats := &cloudlib.RunStats{}
+	gen := cloudlib.DistSearchGen{
+		Speculation: &cloudlib.Speculation{Quantile: 0.5, Multiple: 2},
+		Stats:       stats,
+		Logger:      quiet,
+		Dispatcher:  dispatcher,
+	}
+	search := gen.GetSearch(&graph, &graph.Edges, 2, lib.SplitCombin(graph.Edges.Len(), 1, 3, true))
+
+	done := make(chan struct{})
+	go func() {
+		search.FindNext(lib.BalancedCheck{})
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(10 * time.Second):
+		transport.release()
+		t.Fatal("search waited for the straggling request")
+	}
+
+	if !search.SearchEnded() || len(search.GetResult()) != 0 {
+		t.Errorf("expected an exhausted search, got %v", search.GetResult())
+	}
+	if sent := len(transport.sent()); sent != 4 {
+		t.Errorf("expected the three requests and a copy, %d were sent", sent)
+	}
+
+	// only the first of the two answers of the straggler counts
+	summary := stats.Summary()
+	if summary.Speculative != 1 || summary.Solutions != 3 {
+		t.Errorf("expected one copy and a solution per generator: %+v", summary)
+	}
+}
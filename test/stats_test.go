@@ -0,0 +1,78 @@
+package test
+
+import (
+	"io/ioutil"
+	"log"
+	"net"
+	"os"
+	"testing"
+	"time"
+
+	algo "github.com/cem-okulmus/BalancedGo/algorithms"
+	"github.com/cem-okulmus/BalancedGo/lib"
+	cloudlib "github.com/cem-okulmus/GHDDistributedSearch/lib"
+)
+
+func TestRunStatsAggregate(t *testing.T) {
+	stats := &cloudlib.RunStats{}
+	stats.Add(cloudlib.Solution{Candidates: 10, Checks: 8, WallTime: time.Second, CPUTime: 2 * time.Second, WorkerID: "a"})
+	stats.Add(cloudlib.Solution{Candidates: 5, Checks: 5, WallTime: time.Second, WorkerID: "b", GraphCached: true})
+	stats.Add(cloudlib.Solution{Candidates: 1, Checks: 0, WorkerID: "a", GraphCached: true})
+
+	summary := stats.Summary()
+	if summary.Solutions != 3 || summary.Candidates != 16 || summary.Checks != 13 || summary.CachedGraph != 2 {
+		t.Errorf("wrong counts: %+v", summary)
+	}
+	if summary.WallTime != 2*time.Second || summary.CPUTime != 2*time.Second {
+		t.Errorf("wrong times: %+v", summary)
+	}
+	if len(summary.Workers) != 2 || summary.Workers["a"] != 2 || summary.Workers["b"] != 1 {
+		t.Errorf("wrong solutions by worker: %v", summary.Workers)
+	}
+
+	// the summary is a copy
+	summary.Workers["a"] = 0
+	if stats.Summary().Workers["a"] != 2 {
+		t.Error("changing the summary changed the statistics")
+	}
+}
+
+func TestRunStatsOfSearch(t *testing.T) {
+	log.SetOutput(ioutil.Discard)
+	defer log.SetOutput(os.Stderr)
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	serveTCP(t, listener)
+
+	gen := dispatch(t, &cloudlib.TCPTransport{Addrs: []string{listener.Addr().String()}, Logger: quiet})
+	gen.Stats = &cloudlib.RunStats{}
+
+	dat, err := ioutil.ReadFile("testdata/grid3.hg")
+	if err != nil {
+		t.Fatal(err)
+	}
+	graph, _ := lib.GetGraph(string(dat))
+	solver := algo.LogKDecomp{Graph: graph, K: 2, BalFactor: 2}
+	solver.SetGenerator(gen)
+	if !solver.FindDecomp().Correct(graph) {
+		t.Fatal("no correct decomposition found")
+	}
+
+	// the worker runs in this process, so it reports the same instance ID
+	summary := gen.Stats.Summary()
+	if summary.Solutions == 0 || summary.Workers[cloudlib.WorkerID] != summary.Solutions || len(summary.Workers) != 1 {
+		t.Errorf("solutions not attributed to the worker %s: %v", cloudlib.WorkerID, summary.Workers)
+	}
+	if summary.Checks == 0 || summary.Candidates < summary.Checks {
+		t.Errorf("%d candidates produced for %d checks", summary.Candidates, summary.Checks)
+	}
+	if summary.WallTime <= 0 {
+		t.Error("no time spent by the worker")
+	}
+	if summary.RemoteSearches == 0 || summary.LocalSearches != 0 {
+		t.Errorf("without a threshold all searches are distributed: %+v", summary)
+	}
+}
@@ -0,0 +1,70 @@
+package test
+
+import (
+	"context"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"testing"
+
+	algo "github.com/cem-okulmus/BalancedGo/algorithms"
+	"github.com/cem-okulmus/BalancedGo/lib"
+	cloudlib "github.com/cem-okulmus/GHDDistributedSearch/lib"
+	"go.opentelemetry.io/otel"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+)
+
+func TestSubproblemSpans(t *testing.T) {
+	log.SetOutput(ioutil.Discard)
+	defer log.SetOutput(os.Stderr)
+
+	recorder := tracetest.NewSpanRecorder()
+	provider := sdktrace.NewTracerProvider(sdktrace.WithSpanProcessor(recorder))
+	previous := otel.GetTracerProvider()
+	otel.SetTracerProvider(provider)
+	defer otel.SetTracerProvider(previous)
+
+	dat, err := ioutil.ReadFile(filepath.Join("testdata", "grid3.hg"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	graph, _ := lib.GetGraph(string(dat))
+
+	ctx, span := cloudlib.Tracer().Start(context.Background(), "decomposition")
+	subproblems := cloudlib.NewSubproblems(ctx)
+
+	// every search is done locally, only the spans of the subproblems are of interest
+	decomp := algo.LogKDecomp{Graph: graph, K: 2, BalFactor: 2}
+	decomp.SetGenerator(cloudlib.DistSearchGen{OffloadThreshold: 1e18, Subproblems: subproblems,
+		Logger: cloudlib.NewLogger(ioutil.Discard, cloudlib.LevelOff)})
+	if !decomp.FindDecomp().Correct(graph) {
+		t.Fatal("no decomposition found")
+	}
+	subproblems.End()
+	span.End()
+
+	names := make(map[string]string) // span ID to name
+	for _, s := range recorder.Ended() {
+		names[s.SpanContext().SpanID().String()] = s.Name()
+	}
+
+	var top, nested int
+	for _, s := range recorder.Ended() {
+		if s.Name() != "subproblem" {
+			continue
+		}
+		switch names[s.Parent().SpanID().String()] {
+		case "decomposition":
+			top++
+		case "subproblem":
+			nested++
+		default:
+			t.Errorf("subproblem span has an unknown parent %v", s.Parent().SpanID())
+		}
+	}
+	if top != 1 || nested == 0 {
+		t.Errorf("expected one top-level subproblem with nested ones, got %d top-level and %d nested", top, nested)
+	}
+}
@@ -0,0 +1,423 @@
+package test
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/cem-okulmus/BalancedGo/lib"
+	cloudlib "github.com/cem-okulmus/GHDDistributedSearch/lib"
+	"github.com/gorilla/websocket"
+)
+
+// the test binary doubles as the worker process of the pipe backend
+func TestMain(m *testing.M) {
+	if os.Getenv("GHD_PIPE_WORKER") != "" {
+		servePipe(os.Getenv("GHD_PIPE_CRASH"))
+		return
+	}
+
+	os.Exit(m.Run())
+}
+
+// servePipe runs a worker on the standard input and output. If the marker file does not exist
+// yet, it is created and the worker crashes on its first request instead.
+func servePipe(marker string) {
+	if _, err := os.Stat(marker); marker != "" && os.IsNotExist(err) {
+		ioutil.WriteFile(marker, nil, 0644)
+		os.Stdin.Read(make([]byte, 1))
+		os.Exit(3)
+	}
+
+	worker := cloudlib.NewWorker(cloudlib.NewLogger(ioutil.Discard, cloudlib.LevelOff))
+	if err := worker.ServeStream(context.Background(), os.Stdin, os.Stdout); err != nil {
+		os.Exit(1)
+	}
+}
+
+// serveTCP runs a worker on the listener until the end of the test
+func serveTCP(t *testing.T, listener net.Listener) {
+	ctx, cancel := context.WithCancel(context.Background())
+	t.Cleanup(cancel)
+
+	worker := cloudlib.NewWorker(cloudlib.NewLogger(ioutil.Discard, cloudlib.LevelOff))
+	go worker.ServeTCP(ctx, listener)
+}
+
+// quiet discards the log entries of the tests
+var quiet = cloudlib.NewLogger(ioutil.Discard, cloudlib.LevelOff)
+
+// A backend carries the searches of a test to some workers. Its setup starts the workers,
+// which are stopped at the end of the test, and returns the search generator without any
+// statistics, together with an optional check of the whole run.
+type backend struct {
+	name  string
+	slow  bool // skipped in short mode
+	setup func(t *testing.T) (cloudlib.DistSearchGen, func(t *testing.T, stats []*cloudlib.RunStats))
+}
+
+// dispatch returns a generator sending all searches through a dispatcher on the transport
+func dispatch(t *testing.T, transport cloudlib.Transport) cloudlib.DistSearchGen {
+	dispatcher := &cloudlib.Dispatcher{Transport: transport, Logger: quiet}
+	t.Cleanup(func() { dispatcher.Close() })
+
+	return cloudlib.DistSearchGen{Logger: quiet, Dispatcher: dispatcher}
+}
+
+var backends = []backend{
+	{
+		name: "pubsub",
+		slow: true,
+		setup: func(t *testing.T) (cloudlib.DistSearchGen, func(*testing.T, []*cloudlib.RunStats)) {
+			return newHarness(t).generator(nil), nil
+		},
+	},
+	{
+		// one worker process crashes on its first request, which is sent to the other one
+		name: "pipe",
+		setup: func(t *testing.T) (cloudlib.DistSearchGen, func(*testing.T, []*cloudlib.RunStats)) {
+			marker := filepath.Join(t.TempDir(), "crashed")
+			t.Setenv("GHD_PIPE_WORKER", "1")
+			t.Setenv("GHD_PIPE_CRASH", marker)
+
+			gen := dispatch(t, &cloudlib.PipeTransport{Command: os.Args[0], Workers: 2, Retries: 1, Logger: quiet})
+
+			return gen, func(t *testing.T, _ []*cloudlib.RunStats) {
+				if _, err := os.Stat(marker); err != nil {
+					t.Error("No worker process crashed: ", err)
+				}
+			}
+		},
+	},
+	{
+		// the workers only come up after the master has started connecting, so that the first
+		// requests wait for them
+		name: "tcp",
+		setup: func(t *testing.T) (cloudlib.DistSearchGen, func(*testing.T, []*cloudlib.RunStats)) {
+			addrs := freeAddrs(t, 2)
+			time.AfterFunc(300*time.Millisecond, func() {
+				for _, addr := range addrs {
+					if listener, err := net.Listen("tcp", addr); err == nil {
+						serveTCP(t, listener)
+					}
+				}
+			})
+
+			transport := &cloudlib.TCPTransport{Addrs: addrs, Balancing: cloudlib.RoundRobin, Retries: 1, Logger: quiet}
+
+			return dispatch(t, transport), nil
+		},
+	},
+	{
+		// a volunteer leaves after receiving its first request, which has to be reassigned
+		name: "websocket",
+		setup: func(t *testing.T) (cloudlib.DistSearchGen, func(*testing.T, []*cloudlib.RunStats)) {
+			transport := &cloudlib.WebSocketTransport{Retries: 1, Logger: quiet}
+			gen := dispatch(t, transport)
+
+			srv := httptest.NewServer(transport)
+			t.Cleanup(srv.Close)
+			url := "ws" + strings.TrimPrefix(srv.URL, "http")
+
+			flaky, _, err := websocket.DefaultDialer.Dial(url, nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			go func() {
+				flaky.NextReader()
+				flaky.Close()
+			}()
+
+			ctx, cancel := context.WithCancel(context.Background())
+			t.Cleanup(cancel)
+			go cloudlib.NewWorker(quiet).ServeWebSocket(ctx, url)
+
+			for deadline := time.Now().Add(5 * time.Second); transport.Connected() < 2; {
+				if time.Now().After(deadline) {
+					t.Fatal("workers did not connect")
+				}
+				time.Sleep(10 * time.Millisecond)
+			}
+
+			return gen, func(t *testing.T, _ []*cloudlib.RunStats) {
+				if n := transport.Connected(); n != 1 {
+					t.Errorf("%d workers connected at the end, expected 1", n)
+				}
+			}
+		},
+	},
+	{
+		// every request sent to the broken server has to be sent again to the worker
+		name: "http",
+		setup: func(t *testing.T) (cloudlib.DistSearchGen, func(*testing.T, []*cloudlib.RunStats)) {
+			worker := httptest.NewServer(cloudlib.NewWorker(quiet))
+			t.Cleanup(worker.Close)
+
+			broken := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				http.Error(w, "unavailable", http.StatusServiceUnavailable)
+			}))
+			t.Cleanup(broken.Close)
+
+			transport := &cloudlib.HTTPTransport{
+				URLs:      []string{broken.URL, worker.URL},
+				Balancing: cloudlib.RoundRobin,
+				Retries:   1,
+				Logger:    quiet,
+			}
+
+			return dispatch(t, transport), nil
+		},
+	},
+	{
+		// small chunks, so that each generator is continued by several requests of its session
+		name: "sessions",
+		setup: func(t *testing.T) (cloudlib.DistSearchGen, func(*testing.T, []*cloudlib.RunStats)) {
+			addrs := freeAddrs(t, 2)
+			for _, addr := range addrs {
+				listener, err := net.Listen("tcp", addr)
+				if err != nil {
+					t.Fatal(err)
+				}
+				serveTCP(t, listener)
+			}
+
+			gen := dispatch(t, &cloudlib.TCPTransport{Addrs: addrs, Retries: 1, Logger: quiet})
+			gen.Chunks = cloudlib.NewChunkSizer(time.Millisecond, 5)
+			gen.Chunks.Max = 5
+			gen.Sessions = true
+
+			return gen, func(t *testing.T, stats []*cloudlib.RunStats) {
+				cached := 0
+				for _, s := range stats {
+					cached += s.Summary().CachedGraph
+				}
+				if cached == 0 {
+					t.Error("no request used the graph held by a session")
+				}
+			}
+		},
+	},
+}
+
+// freeAddrs returns local addresses on which nothing listens
+func freeAddrs(t *testing.T, n int) []string {
+	var addrs []string
+	for i := 0; i < n; i++ {
+		listener, err := net.Listen("tcp", "127.0.0.1:0")
+		if err != nil {
+			t.Fatal(err)
+		}
+		addrs = append(addrs, listener.Addr().String())
+		listener.Close()
+	}
+
+	return addrs
+}
+
+func TestBackends(t *testing.T) {
+	for _, b := range backends {
+		b := b
+		t.Run(b.name, func(t *testing.T) {
+			if b.slow && testing.Short() {
+				t.Skip("skipping integration test in short mode")
+			}
+
+			gen, check := b.setup(t)
+
+			var all []*cloudlib.RunStats
+			compareWithLocal(t, func(stats *cloudlib.RunStats) lib.SearchGenerator {
+				all = append(all, stats)
+				gen.Stats = stats
+				return gen
+			})
+
+			if check != nil {
+				check(t, all)
+			}
+		})
+	}
+}
+
+func TestSendDoesNotWaitForWrites(t *testing.T) {
+	// the worker accepts the connection, but never reads from it
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+	accepted := make(chan struct{})
+	go func() {
+		if conn, err := listener.Accept(); err == nil {
+			defer conn.Close()
+			close(accepted)
+			time.Sleep(time.Minute)
+		}
+	}()
+
+	transport := &cloudlib.TCPTransport{Addrs: []string{listener.Addr().String()}, Logger: quiet}
+	defer transport.Close()
+
+	// the first request waits for the connection, the others are written to it
+	first := cloudlib.Message{Data: []byte{}, Attributes: map[string]string{"request": "first"}}
+	if err := transport.Send(context.Background(), first); err != nil {
+		t.Fatal(err)
+	}
+	<-accepted
+	time.Sleep(100 * time.Millisecond)
+
+	// far more than the buffers of the connection hold
+	start := time.Now()
+	for i := 0; i < 64; i++ {
+		msg := cloudlib.Message{Data: make([]byte, 1<<20), Attributes: map[string]string{"request": fmt.Sprint(i)}}
+		if err := transport.Send(context.Background(), msg); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if elapsed := time.Since(start); elapsed > 5*time.Second {
+		t.Errorf("sending took %v, waiting for the worker to read", elapsed)
+	}
+}
+
+// statusRecorder keeps the status of a response
+type statusRecorder struct {
+	http.ResponseWriter
+	status int
+}
+
+func (s *statusRecorder) WriteHeader(status int) {
+	s.status = status
+	s.ResponseWriter.WriteHeader(status)
+}
+
+// heldCheck is a predicate rejecting every separator, but only once heldChecks has been closed
+type heldCheck struct{}
+
+// heldChecks holds up the searches of heldCheck
+var heldChecks chan struct{}
+
+func (heldCheck) Check(H *lib.Graph, sep *lib.Edges, balFactor int) bool {
+	<-heldChecks
+	return false
+}
+
+func TestHTTPPollsSearchInProgress(t *testing.T) {
+	heldChecks = make(chan struct{})
+	var release sync.Once
+
+	var mux sync.Mutex
+	var statuses []int
+	handler := cloudlib.NewWorker(quiet)
+	worker := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		recorder := &statusRecorder{ResponseWriter: w, status: http.StatusOK}
+		handler.ServeHTTP(recorder, r)
+
+		mux.Lock()
+		statuses = append(statuses, recorder.status)
+		mux.Unlock()
+
+		// the search goes on once the request, having timed out, met the earlier attempt
+		if recorder.status == http.StatusConflict {
+			release.Do(func() { close(heldChecks) })
+		}
+	}))
+	defer worker.Close()
+
+	// the request times out while the worker is searching it, and is sent there again
+	transport := &cloudlib.HTTPTransport{URLs: []string{worker.URL}, Retries: 1, Timeout: 200 * time.Millisecond, Logger: quiet}
+	dispatcher := &cloudlib.Dispatcher{Transport: transport, Logger: quiet}
+	defer dispatcher.Close()
+
+	graph, _ := getRandomGraph(8)
+	search := cloudlib.DistSearchGen{Logger: quiet, Dispatcher: dispatcher}.
+		GetSearch(&graph, &graph.Edges, 2, lib.SplitCombin(graph.Edges.Len(), 2, 1, false))
+
+	done := make(chan struct{})
+	go func() {
+		search.FindNext(heldCheck{})
+		close(done)
+	}()
+
+	select {
+	case <-done:
+	case <-time.After(20 * time.Second):
+		release.Do(func() { close(heldChecks) })
+		t.Fatal("search still waiting for the request searched under an earlier attempt")
+	}
+
+	// the conflicts come first, as the timed out attempt is held up until then, and the poll
+	// finding the reply comes last
+	mux.Lock()
+	defer mux.Unlock()
+	if len(statuses) < 3 || statuses[0] != http.StatusConflict || statuses[len(statuses)-1] != http.StatusOK {
+		t.Fatalf("request was not polled until the worker had the reply, statuses %v", statuses)
+	}
+	count := make(map[int]int)
+	for _, status := range statuses {
+		count[status]++
+	}
+	if count[http.StatusOK] != 2 || count[http.StatusConflict] != len(statuses)-2 {
+		t.Errorf("expected the timed out attempt and the poll to succeed, and conflicts otherwise, statuses %v", statuses)
+	}
+}
+
+// corruptFirst flips a byte of the first request sent, leaving its checksum as it was
+type corruptFirst struct {
+	cloudlib.Transport
+	corrupted int32
+}
+
+func (c *corruptFirst) Send(ctx context.Context, msg cloudlib.Message) error {
+	if atomic.CompareAndSwapInt32(&c.corrupted, 0, 1) {
+		data := append([]byte{}, msg.Data...)
+		data[len(data)/2] ^= 0xff
+		msg = cloudlib.Message{Data: data, Attributes: msg.Attributes}
+	}
+
+	return c.Transport.Send(ctx, msg)
+}
+
+func TestPipeWorkerAnswersCorruptRequest(t *testing.T) {
+	t.Setenv("GHD_PIPE_WORKER", "1")
+	t.Setenv("GHD_PIPE_CRASH", "")
+
+	transport := &corruptFirst{Transport: &cloudlib.PipeTransport{Command: os.Args[0], Workers: 1, Logger: quiet}}
+	dispatcher := &cloudlib.Dispatcher{Transport: transport, Logger: quiet}
+	defer dispatcher.Close()
+
+	// no single edge of the cycle is a balanced separator, so every generator has to be exhausted
+	dat, err := ioutil.ReadFile("testdata/cycle6.hg")
+	if err != nil {
+		t.Fatal(err)
+	}
+	graph, _ := lib.GetGraph(string(dat))
+	search := cloudlib.DistSearchGen{Logger: quiet, Dispatcher: dispatcher}.
+		GetSearch(&graph, &graph.Edges, 2, lib.SplitCombin(graph.Edges.Len(), 1, 2, true)).(*cloudlib.DistributedSearch)
+
+	done := make(chan struct{})
+	go func() {
+		search.FindNext(lib.BalancedCheck{})
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(20 * time.Second):
+		t.Fatal("search still waiting for the reply to the corrupt request")
+	}
+
+	if atomic.LoadInt32(&transport.corrupted) == 0 {
+		t.Error("no request corrupted, the test does not cover it")
+	}
+	if search.Err != nil || !search.SearchEnded() || len(search.GetResult()) != 0 {
+		t.Errorf("expected an exhausted search, got %v (%v)", search.GetResult(), search.Err)
+	}
+}
@@ -0,0 +1,134 @@
+package test
+
+import (
+	"context"
+	"errors"
+	"io/ioutil"
+	"runtime"
+	"testing"
+
+	"github.com/cem-okulmus/BalancedGo/lib"
+	cloudlib "github.com/cem-okulmus/GHDDistributedSearch/lib"
+)
+
+func validRequest() cloudlib.Request {
+	graph, _ := getRandomGraph(8)
+
+	return cloudlib.Request{
+		Subgraph:  graph,
+		Edges:     graph.Edges,
+		Predicate: lib.BalancedCheck{},
+		Gen:       lib.SplitCombin(graph.Edges.Len(), 2, 1, false)[0],
+		BalFactor: 2,
+		ID:        "valid",
+		Limit:     50,
+	}
+}
+
+func TestRejectInvalidRequest(t *testing.T) {
+	tooMany := validRequest()
+	tooMany.Gen = lib.SplitCombin(tooMany.Edges.Len()+1, 2, 1, false)[0]
+
+	noPredicate := validRequest()
+	noPredicate.Predicate = nil
+
+	worker := cloudlib.NewWorker(cloudlib.NewLogger(ioutil.Discard, cloudlib.LevelOff))
+	worker.Limits.MaxEdges = 100
+
+	var edges []lib.Edge
+	for i := 1; i <= 101; i++ {
+		edges = append(edges, lib.Edge{Name: i, Vertices: []int{i, i + 1}})
+	}
+	tooLarge := validRequest()
+	tooLarge.Subgraph = lib.Graph{Edges: lib.NewEdges(edges)}
+
+	for name, req := range map[string]cloudlib.Request{
+		"generator": tooMany,
+		"predicate": noPredicate,
+		"limits":    tooLarge,
+	} {
+		req.ID = name // replies are cached by request ID
+		data := encodeRequest(t, req)
+
+		out, _, err := worker.Handle(context.Background(), data, nil, nil)
+		if err != nil {
+			t.Fatal(name, ": ", err)
+		}
+		sol, err := cloudlib.DecodeSolution(out)
+		if err != nil {
+			t.Fatal(name, ": ", err)
+		}
+		if sol.Error == "" || sol.ID != req.ID {
+			t.Errorf("%s: invalid request was not rejected: %+v", name, sol)
+		}
+	}
+
+	// the edges are counted before they are decoded
+	var empty []lib.Edge
+	for i := 0; i < 1<<20; i++ {
+		empty = append(empty, lib.Edge{})
+	}
+	tooMany.Subgraph = lib.Graph{Edges: lib.NewEdges(empty)}
+	tooMany.ID = "counted"
+	data := encodeRequest(t, tooMany)
+
+	var before, after runtime.MemStats
+	runtime.ReadMemStats(&before)
+	out, _, err := worker.Handle(context.Background(), data, nil, nil)
+	runtime.ReadMemStats(&after)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if sol, err := cloudlib.DecodeSolution(out); err != nil || sol.Error == "" || sol.ID != tooMany.ID {
+		t.Errorf("request with too many edges was not rejected: %+v %v", sol, err)
+	}
+	if allocated := after.TotalAlloc - before.TotalAlloc; allocated > 8*uint64(len(data)) {
+		t.Errorf("rejecting %d bytes allocated %d bytes", len(data), allocated)
+	}
+
+	// undecodable data can only be answered if the request ID is known
+	_, _, err = worker.Handle(context.Background(), []byte("garbage"), nil, nil)
+	if !errors.Is(err, cloudlib.ErrInvalid) {
+		t.Error("Garbage was not rejected: ", err)
+	}
+}
+
+func FuzzDecodeRequest(f *testing.F) {
+	data := encodeRequest(f, validRequest())
+	f.Add(data)
+	f.Add(data[:len(data)/2])
+	f.Add([]byte{})
+
+	f.Fuzz(func(t *testing.T, data []byte) {
+		req, err := cloudlib.DecodeRequest(data)
+		if err != nil {
+			return
+		}
+
+		// a request passing validation must be searchable without failing
+		req.Limit = 50
+		if _, err = cloudlib.Work(req, nil); err != nil {
+			t.Fatal("valid request failed: ", err)
+		}
+	})
+}
+
+func FuzzHandle(f *testing.F) {
+	data := encodeRequest(f, validRequest())
+	f.Add(data, "valid")
+	f.Add(data[:len(data)/2], "truncated")
+
+	worker := cloudlib.NewWorker(cloudlib.NewLogger(ioutil.Discard, cloudlib.LevelOff))
+
+	f.Fuzz(func(t *testing.T, data []byte, id string) {
+		out, _, err := worker.Handle(context.Background(), data, map[string]string{"request": id}, nil)
+		if err != nil {
+			return
+		}
+
+		// every reply has to be readable by the master
+		if _, err = cloudlib.DecodeSolution(out); err != nil {
+			t.Fatal("reply cannot be decoded: ", err)
+		}
+	})
+}
@@ -0,0 +1,240 @@
+package test
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"encoding/gob"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	algo "github.com/cem-okulmus/BalancedGo/algorithms"
+	"github.com/cem-okulmus/BalancedGo/lib"
+	cloudlib "github.com/cem-okulmus/GHDDistributedSearch/lib"
+	"github.com/gorilla/websocket"
+)
+
+// serveWebSocket mounts the transport on a test server, returning the URL workers connect to
+func serveWebSocket(t *testing.T, transport *cloudlib.WebSocketTransport) string {
+	t.Cleanup(func() { transport.Close() })
+
+	srv := httptest.NewServer(transport)
+	t.Cleanup(srv.Close)
+
+	return "ws" + strings.TrimPrefix(srv.URL, "http")
+}
+
+func TestWebSocketAdmission(t *testing.T) {
+	transport := &cloudlib.WebSocketTransport{
+		Token:   "secret",
+		Origins: []string{"https://volunteers.example"},
+		Logger:  quiet,
+	}
+	url := serveWebSocket(t, transport)
+
+	for _, c := range []struct {
+		name   string
+		url    string
+		header http.Header
+		status int
+	}{
+		{name: "no token", url: url, status: http.StatusUnauthorized},
+		{name: "wrong token", url: url + "?token=guess", status: http.StatusUnauthorized},
+		{name: "bearer token", url: url, header: http.Header{"Authorization": {"Bearer secret"}}},
+		{name: "token in url", url: url + "?token=secret", header: http.Header{"Origin": {"https://volunteers.example"}}},
+		{
+			name:   "other origin",
+			url:    url + "?token=secret",
+			header: http.Header{"Origin": {"https://elsewhere.example"}},
+			status: http.StatusForbidden,
+		},
+	} {
+		conn, resp, err := websocket.DefaultDialer.Dial(c.url, c.header)
+		if c.status == 0 {
+			if err != nil {
+				t.Errorf("%s: worker was not admitted: %v", c.name, err)
+				continue
+			}
+			conn.Close()
+			continue
+		}
+		if err == nil {
+			conn.Close()
+			t.Errorf("%s: worker was admitted", c.name)
+			continue
+		}
+		if resp == nil || resp.StatusCode != c.status {
+			t.Errorf("%s: expected status %d, got %v", c.name, c.status, resp)
+		}
+	}
+
+	// the worker presents its token by itself
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	worker := cloudlib.NewWorker(quiet)
+	worker.Token = "secret"
+	go worker.ServeWebSocket(ctx, url)
+
+	for deadline := time.Now().Add(5 * time.Second); transport.Connected() < 1; {
+		if time.Now().After(deadline) {
+			t.Fatal("worker with the token did not connect")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+// lie answers the requests received over the connection with the messages returned by answer,
+// which is told how many requests came before, as a malicious volunteer might
+func lie(conn *websocket.Conn, answer func(n int, req cloudlib.Request) []cloudlib.Message) {
+	defer conn.Close()
+
+	for n := 0; ; n++ {
+		_, frame, err := conn.ReadMessage()
+		if err != nil || len(frame) < 4 {
+			return
+		}
+		var msg cloudlib.Message
+		if err = gob.NewDecoder(bytes.NewReader(frame[4:])).Decode(&msg); err != nil {
+			return
+		}
+		req, err := cloudlib.DecodeRequest(msg.Data)
+		if err != nil {
+			return
+		}
+
+		for _, reply := range answer(n, req) {
+			var buffer bytes.Buffer
+			buffer.Write(make([]byte, 4))
+			gob.NewEncoder(&buffer).Encode(reply)
+			frame := buffer.Bytes()
+			binary.BigEndian.PutUint32(frame, uint32(len(frame)-4))
+
+			if err = conn.WriteMessage(websocket.BinaryMessage, frame); err != nil {
+				return
+			}
+		}
+	}
+}
+
+func TestWebSocketSeparatorsChecked(t *testing.T) {
+	log.SetOutput(ioutil.Discard)
+	defer log.SetOutput(os.Stderr)
+
+	transport := &cloudlib.WebSocketTransport{Logger: quiet}
+	dispatcher := &cloudlib.Dispatcher{Transport: transport, Logger: quiet}
+	defer dispatcher.Close()
+	url := serveWebSocket(t, transport)
+
+	conn, _, err := websocket.DefaultDialer.Dial(url, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// every request is answered with a separator made up of the first edge
+	go lie(conn, func(n int, req cloudlib.Request) []cloudlib.Message {
+		return []cloudlib.Message{scripted(t, req.ID, cloudlib.Solution{ID: req.ID, Valid: true, Selection: []int{0}, Gen: req.Gen})}
+	})
+
+	// no single edge of the cycle is a balanced separator
+	dat, err := ioutil.ReadFile("testdata/cycle6.hg")
+	if err != nil {
+		t.Fatal(err)
+	}
+	graph, _ := lib.GetGraph(string(dat))
+
+	solver := algo.LogKDecomp{Graph: graph, K: 2, BalFactor: 2}
+	solver.SetGenerator(cloudlib.DistSearchGen{Logger: quiet, Dispatcher: dispatcher})
+	if decomp := solver.FindDecomp(); !decomp.Correct(graph) {
+		t.Error("the separators of the worker were accepted without checking them")
+	}
+}
+
+func TestWebSocketGeneratorsChecked(t *testing.T) {
+	log.SetOutput(ioutil.Discard)
+	defer log.SetOutput(os.Stderr)
+
+	// two opposite edges of the cycle are a balanced separator
+	dat, err := ioutil.ReadFile("testdata/cycle6.hg")
+	if err != nil {
+		t.Fatal(err)
+	}
+	graph, _ := lib.GetGraph(string(dat))
+	m := graph.Edges.Len()
+
+	// the worker lies about the first request, and searches the others honestly
+	for _, c := range []struct {
+		name string
+		lie  func(req cloudlib.Request) []cloudlib.Message
+	}{
+		{
+			// the generator is exhausted without checking the chunk
+			name: "skipped",
+			lie: func(req cloudlib.Request) []cloudlib.Message {
+				gen := *req.Gen.(*lib.CombinationIterator)
+				gen.K, gen.Combination, gen.Empty = 1, []int{m - 1}, true
+				return []cloudlib.Message{scripted(t, req.ID, cloudlib.Solution{ID: req.ID, Gen: &gen})}
+			},
+		},
+		{
+			// the worker reports progress beyond the edges, and gives up
+			name: "out of range",
+			lie: func(req cloudlib.Request) []cloudlib.Message {
+				gen := *req.Gen.(*lib.CombinationIterator)
+				gen.Combination, gen.Confirmed = []int{0, m + 5}, true
+				return []cloudlib.Message{
+					scripted(t, req.ID, cloudlib.Progress{ID: req.ID, Gen: &gen, Candidates: 1}),
+					scripted(t, req.ID, cloudlib.Solution{ID: req.ID, Error: "out of memory"}),
+				}
+			},
+		},
+	} {
+		transport := &cloudlib.WebSocketTransport{Logger: quiet}
+		dispatcher := &cloudlib.Dispatcher{Transport: transport, Logger: quiet}
+		url := serveWebSocket(t, transport)
+
+		conn, _, err := websocket.DefaultDialer.Dial(url, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		lying := c.lie
+		go lie(conn, func(n int, req cloudlib.Request) []cloudlib.Message {
+			if n == 0 {
+				return lying(req)
+			}
+			sol, _ := cloudlib.Work(req, nil)
+			return []cloudlib.Message{scripted(t, req.ID, sol)}
+		})
+
+		chunks := cloudlib.NewChunkSizer(time.Millisecond, 5)
+		chunks.Max = 5
+		gen := cloudlib.DistSearchGen{Chunks: chunks, Logger: quiet, Dispatcher: dispatcher}
+		search := gen.GetSearch(&graph, &graph.Edges, 2, lib.SplitCombin(m, 2, 1, true)).(*cloudlib.DistributedSearch)
+
+		done := make(chan struct{})
+		go func() {
+			search.FindNext(lib.BalancedCheck{})
+			close(done)
+		}()
+		select {
+		case <-done:
+		case <-time.After(20 * time.Second):
+			t.Fatalf("%s: search did not end", c.name)
+		}
+		dispatcher.Close()
+
+		if search.Err != nil {
+			t.Errorf("%s: search failed: %v", c.name, search.Err)
+			continue
+		}
+		selection := search.GetResult()
+		sep := lib.GetSubset(graph.Edges, selection)
+		if len(selection) == 0 || !(lib.BalancedCheck{}).Check(&graph, &sep, 2) {
+			t.Errorf("%s: expected a balanced separator, got %v", c.name, selection)
+		}
+	}
+}
@@ -0,0 +1,98 @@
+package test
+
+import (
+	"bytes"
+	"context"
+	"encoding/gob"
+	"io/ioutil"
+	"testing"
+
+	"github.com/cem-okulmus/BalancedGo/lib"
+	cloudlib "github.com/cem-okulmus/GHDDistributedSearch/lib"
+)
+
+func encodeRequest(t testing.TB, req cloudlib.Request) []byte {
+	var Encodebuffer bytes.Buffer
+	enc := gob.NewEncoder(&Encodebuffer)
+
+	if err := enc.Encode(req); err != nil {
+		t.Fatal("encode error", err)
+	}
+
+	return Encodebuffer.Bytes()
+}
+
+func TestDuplicateRequest(t *testing.T) {
+	graph, _ := getRandomGraph(10)
+
+	req := cloudlib.Request{
+		Subgraph:  graph,
+		Edges:     graph.Edges,
+		Predicate: lib.BalancedCheck{},
+		Gen:       lib.SplitCombin(graph.Edges.Len(), 2, 1, false)[0],
+		BalFactor: 2,
+		ID:        "duplicate",
+	}
+	data := encodeRequest(t, req)
+
+	worker := cloudlib.NewWorker(cloudlib.NewLogger(ioutil.Discard, cloudlib.LevelOff))
+
+	first, _, err := worker.Handle(context.Background(), data, nil, nil)
+	if err != nil {
+		t.Fatal("first delivery: ", err)
+	}
+
+	second, _, err := worker.Handle(context.Background(), data, map[string]string{"request": req.ID}, nil)
+	if err != nil {
+		t.Fatal("second delivery: ", err)
+	}
+
+	if !bytes.Equal(first, second) {
+		t.Errorf("Redelivered request was not answered with the cached reply")
+	}
+}
+
+// panicCheck is a predicate whose check always panics
+type panicCheck struct{}
+
+func (panicCheck) Check(H *lib.Graph, sep *lib.Edges, balFactor int) bool {
+	panic("check failed")
+}
+
+func TestSearchPanics(t *testing.T) {
+	worker := cloudlib.NewWorker(quiet)
+
+	req := validRequest()
+	req.Predicate = panicCheck{}
+	data, err := cloudlib.EncodeRequest(req) // registers the predicate
+	if err != nil {
+		t.Fatal(err)
+	}
+	out, _, err := worker.Handle(context.Background(), data, nil, nil)
+	if err != nil {
+		t.Fatal("no reply to the failed search: ", err)
+	}
+	sol, err := cloudlib.DecodeSolution(out)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if sol.Error == "" || sol.ID != req.ID {
+		t.Errorf("reply does not tell the master of the failure: %+v", sol)
+	}
+
+	// the master searches the rejected request itself, failing as well
+	dispatcher := &cloudlib.Dispatcher{Transport: &cloudlib.SimTransport{Worker: worker}, Logger: quiet}
+	defer dispatcher.Close()
+
+	stats := &cloudlib.RunStats{}
+	search := cloudlib.DistSearchGen{Logger: quiet, Dispatcher: dispatcher, Stats: stats}.
+		GetSearch(&req.Subgraph, &req.Edges, 2, lib.SplitCombin(req.Edges.Len(), 2, 1, false))
+	search.FindNext(panicCheck{})
+
+	if err := search.(*cloudlib.DistributedSearch).Err; err == nil {
+		t.Error("failed search was not marked as such")
+	}
+	if failed := stats.Summary().Failed; failed != 1 {
+		t.Errorf("%d failed searches counted, expected 1", failed)
+	}
+}
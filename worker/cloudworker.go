@@ -0,0 +1,140 @@
+package main
+
+// A standalone worker for the distributed search, doing the same job as the cloud function but as
+// a long-running process, pulling requests from a subscription on the worker topic. With -pipe, it
+// serves a master which started it as a subprocess instead, with -listen, masters connecting
+// over TCP, with -connect, it joins a master accepting workers over a WebSocket, and with -http, it
+// answers requests POSTed over HTTP.
+
+import (
+	"context"
+	"flag"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"os/signal"
+	"syscall"
+
+	"cloud.google.com/go/pubsub"
+	cloudlib "github.com/cem-okulmus/GHDDistributedSearch/lib"
+)
+
+func main() {
+	projectID := flag.String("project", "hgtest-1", "Google Cloud Platform project ID")
+	subID := flag.String("sub", "workerTopic-sub", "subscription on the worker topic to pull requests from")
+	answerTopic := flag.String("answer", "answerTopic", "topic to publish the solutions to")
+	requestTopic := flag.String("requests", "workerTopic", "topic the requests are published to, only used by -provision")
+	provision := flag.Bool("provision", false, "create the topics and the subscription if they do not exist (e.g. on the emulator)")
+	metricsAddr := flag.String("metrics", ":9091", "address to expose the /metrics endpoint on, empty to disable")
+	traceExporter := flag.String("trace", "", "export traces to \"stdout\" or \"file:<path>\", empty to disable")
+	logLevel := flag.String("loglevel", "info", "minimum level of log entries: debug, info, warn, error or off")
+	publishDelay := flag.Duration("publishDelay", pubsub.DefaultPublishSettings.DelayThreshold, "maximal time to batch answers before publishing them")
+	pipe := flag.Bool("pipe", false, "serve framed requests on standard input and output instead of Pub/Sub (metrics are disabled)")
+	listen := flag.String("listen", "", "serve masters connecting over TCP on this address (e.g. :7070) instead of Pub/Sub")
+	connect := flag.String("connect", "", "join the master accepting workers over a WebSocket at this URL (e.g. ws://host:7080/ws) instead of using Pub/Sub")
+	token := flag.String("token", "", "token to present to the master with -connect, if it requires one (see its -websocketToken flag)")
+	httpAddr := flag.String("http", "", "answer requests POSTed over HTTP on this address (e.g. :8080) instead of using Pub/Sub")
+	publishCount := flag.Int("publishCount", pubsub.DefaultPublishSettings.CountThreshold, "maximal number of answers published in one batch")
+	flag.Parse()
+
+	level, err := cloudlib.ParseLevel(*logLevel)
+	if err != nil {
+		log.Fatal(err)
+	}
+	worker := cloudlib.NewWorker(cloudlib.NewLogger(os.Stderr, level))
+
+	if *pipe {
+		*metricsAddr = "" // the sibling processes would compete for the address
+	}
+	cloudlib.ServeMetrics(*metricsAddr)
+
+	shutdown, err := cloudlib.SetupTracing(*traceExporter, "ghd-worker")
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer shutdown()
+
+	// stop pulling on a signal, so the answers still in flight can be published before exiting
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	if *pipe {
+		// the master closes the pipe or kills this process when it is done
+		if err = worker.ServeStream(ctx, os.Stdin, os.Stdout); err != nil {
+			log.Fatal(err)
+		}
+		return
+	}
+
+	if *httpAddr != "" {
+		server := &http.Server{Addr: *httpAddr, Handler: worker}
+		go func() {
+			<-ctx.Done()
+			server.Shutdown(context.Background()) // lets the searches in progress answer
+		}()
+
+		worker.Logger.Info("Waiting for requests", "address", *httpAddr)
+		if err = server.ListenAndServe(); err != http.ErrServerClosed {
+			log.Fatal(err)
+		}
+		worker.Logger.Info("Shutting down")
+		return
+	}
+
+	if *connect != "" {
+		worker.Token = *token
+		if err = worker.ServeWebSocket(ctx, *connect); err != nil {
+			log.Fatal(err)
+		}
+		worker.Logger.Info("Shutting down")
+		return
+	}
+
+	if *listen != "" {
+		listener, err := net.Listen("tcp", *listen)
+		if err != nil {
+			log.Fatal(err)
+		}
+		worker.Logger.Info("Waiting for masters", "address", listener.Addr().String())
+
+		if err = worker.ServeTCP(ctx, listener); err != nil {
+			log.Fatal(err)
+		}
+		worker.Logger.Info("Shutting down")
+		return
+	}
+
+	client, err := pubsub.NewClient(ctx, *projectID)
+	if err != nil {
+		log.Fatalf("Failed to create client: %v", err)
+	}
+	defer client.Close()
+
+	if *provision {
+		topology := cloudlib.Topology{
+			RequestTopic:       *requestTopic,
+			AnswerTopic:        *answerTopic,
+			WorkerSubscription: *subID,
+		}
+		if err := topology.EnsureTopics(ctx, client); err != nil {
+			log.Fatal(err)
+		}
+	}
+
+	topic := client.Topic(*answerTopic)
+	topic.PublishSettings.DelayThreshold = *publishDelay
+	topic.PublishSettings.CountThreshold = *publishCount
+	defer topic.Stop()
+
+	sub := client.Subscription(*subID)
+
+	worker.Logger.Info("Waiting for requests", "subscription", *subID)
+
+	err = worker.Serve(ctx, sub, topic)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	worker.Logger.Info("Shutting down")
+}